@@ -60,7 +60,10 @@ func main() {
 	frontend.RegisterRoutes(&client, serverURL, &database, &his)
 	// duration_min := 5
 	// polling := pollinghandler.NewPollingHandler(duration_min*60, &client, &database, serverURL)
-	polling := pollinghandler.NewPollingHandler(5, &client, &database, serverURL)
+	polling, err := pollinghandler.NewPollingHandler(5, &client, &database, serverURL)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	go polling.Run()
 
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net/http"
 	"path"
 	"simplemts/lib"
 	db "simplemts/lib/database"
 	frontendhandler "simplemts/referralServer/frontendHandler"
+	"simplemts/referralServer/jobs"
 	routehandler "simplemts/referralServer/routeHandler"
 	"simplemts/referralServer/server"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -39,6 +43,22 @@ func main() {
 	routehandler.RegisterRoutes(server, &database)
 	frontend.RegisterRoutes(&database)
 
+	scheduler := jobs.Scheduler{}
+	scheduler.Add(jobs.SLAMonitor(&database))
+	// deliveries also present the central certificate for hospitals checking mTLS
+	certificate, err := lib.LoadCert(cert, key)
+	if err != nil {
+		log.Fatalf("Unable to load certificate for webhooks: %s", err)
+	}
+	webhookClient := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{certificate}},
+		},
+	}
+	scheduler.Add(jobs.WebhookJob(jobs.NewWebhookSender(&database, webhookClient)))
+	scheduler.Start(make(chan struct{}))
+
 	frontendErrors := make(chan error)
 	go func() {
 		frontendErrors <- frontend.Serve()
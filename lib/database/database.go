@@ -1,9 +1,11 @@
 package database
 
 import (
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -19,8 +21,66 @@ const (
 	Granted          ReferralStatus = "Granted"
 	UploadIncomplete ReferralStatus = "UploadIncomplete"
 	UploadComplete   ReferralStatus = "UploadComplete"
+	Forwarded        ReferralStatus = "Forwarded" // sent on to another destination, waits for the patient's consent again
+
+	// Counter-referral, results sent back from the destination to the origin
+	CounterCreated          ReferralStatus = "CounterCreated"
+	CounterUploadIncomplete ReferralStatus = "CounterUploadIncomplete"
+	CounterUploadComplete   ReferralStatus = "CounterUploadComplete"
+	CounterComplete         ReferralStatus = "CounterComplete"
 
 	NotGranted ReferralStatus = "NotGranted"
+	Rejected   ReferralStatus = "Rejected"  // payload failed verification at the destination
+	Cancelled  ReferralStatus = "Cancelled" // withdrawn by the origin
+	Expired    ReferralStatus = "Expired"   // stuck past its SLA, closed by the monitor
+)
+
+type Urgency string
+
+const (
+	Emergency Urgency = "emergency"
+	Urgent    Urgency = "urgent"
+	Routine   Urgency = "routine"
+)
+
+// Lower comes first in /incoming
+func (u Urgency) Priority() int {
+	switch u {
+	case Emergency:
+		return 0
+	case Urgent:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Why a destination did not grant a referral
+type DeclineCode string
+
+const (
+	NoCapacity       DeclineCode = "NoCapacity"
+	WrongDepartment  DeclineCode = "WrongDepartment"
+	NeedsInformation DeclineCode = "NeedsInformation"
+	OtherDecline     DeclineCode = "Other"
+)
+
+// Where a candidate destination of a broadcast referral stands
+type CandidateStatus string
+
+const (
+	CandidatePending     CandidateStatus = "Pending"
+	CandidateClaimed     CandidateStatus = "Claimed"
+	CandidateDeclined    CandidateStatus = "Declined"
+	CandidateUnavailable CandidateStatus = "Unavailable" // another candidate claimed the referral
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "Pending"
+	DeliveryDelivered DeliveryStatus = "Delivered"
+	DeliveryFailed    DeliveryStatus = "Failed" // gave up after the last retry
 )
 
 type UploadStatus string
@@ -30,6 +90,17 @@ const (
 	CompleteUpload   UploadStatus = "UploadComplete"
 )
 
+// Destination side file status
+type DownloadStatus string
+
+const (
+	IncompleteDownload DownloadStatus = "DownloadIncomplete"
+	ChecksumMismatch   DownloadStatus = "ChecksumMismatch"
+	VerifiedDownload   DownloadStatus = "DownloadVerified"
+	DecryptFailed      DownloadStatus = "DecryptFailed"
+	CompleteDownload   DownloadStatus = "DownloadComplete"
+)
+
 type ChunkStatus = string
 
 const (
@@ -80,6 +151,26 @@ type FileObject struct {
 // DB Types
 type Database struct {
 	database *gorm.DB
+	changes  *changeSignal
+}
+
+// Wakes everyone waiting for the next referral change
+type changeSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (s *changeSignal) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ch
+}
+
+func (s *changeSignal) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.ch)
+	s.ch = make(chan struct{})
 }
 
 type Referral struct {
@@ -91,6 +182,25 @@ type Referral struct {
 	ReferralStatus ReferralStatus
 	Created        int64  `gorm:"autoCreateTime"`
 	PayloadKey     string `gorm:"payloadKey"`
+	// Signed by the origin, checked by the destination before decrypting
+	Manifest          string
+	ManifestSignature string
+	// Signed by the destination on completion, with the certificate it was verified against
+	Receipt            string
+	ReceiptSignature   string
+	ReceiptCertificate string
+	CancelReason       string
+	// Set when the destination did not grant
+	DeclineCode   DeclineCode
+	DeclineReason string
+	// Original referral of a counter-referral, 0 otherwise
+	CounterTo int
+	Urgency   Urgency
+	Deadline  int64 // unix time the destination has to answer by
+	// Status the SLA monitor raised an escalation in, cleared on every transition
+	Escalated ReferralStatus
+	// Change sequence, raised on every write pollers see
+	Seq int64 `gorm:"index"`
 }
 
 // Like a receipt for outgoing referrals
@@ -113,15 +223,98 @@ type Hospital struct {
 	HospitalId   string `json:"HospitalId" validate:"required"`
 	HospitalName string `json:"HospitalName" validate:"required"`
 	CertSerial   string
+	Certificate  string `json:"-"` // PEM, recorded from the hospital's client certificate
+	// Called on every event of the hospital's referrals, signed with the secret
+	WebhookURL    string `json:"-"`
+	WebhookSecret string `json:"-"`
 }
 
 type File struct {
+	Id             int `gorm:"primaryKey;autoIncrement"`
+	Referral       int
+	ReferralModel  Referral `gorm:"foreignKey:Referral;references:Id"`
+	ParentPath     string
+	UploadStatus   UploadStatus
+	DownloadStatus DownloadStatus
+	FileObject
+}
+
+// Upload chunk tracking, one row per chunk
+type FileChunk struct {
 	Id            int `gorm:"primaryKey;autoIncrement"`
 	Referral      int
 	ReferralModel Referral `gorm:"foreignKey:Referral;references:Id"`
-	ParentPath    string
-	UploadStatus  UploadStatus
-	FileObject
+	FileName      string
+	ChunkIndex    int
+	Chunk
+}
+
+// Destination a referral was broadcast to, the first to grant becomes the destination
+type ReferralCandidate struct {
+	Id            int      `gorm:"primaryKey;autoIncrement"`
+	Referral      int      `json:"Referral"`
+	ReferralModel Referral `gorm:"foreignKey:Referral;references:Id" json:"-"`
+	HospitalId    string
+	Rank          int // 0 when the candidates are unordered
+	Status        CandidateStatus
+	DeclineCode   DeclineCode
+	DeclineReason string
+}
+
+// One step of a referral's forwarding chain
+type ReferralForward struct {
+	Id            int      `gorm:"primaryKey;autoIncrement"`
+	Referral      int      `json:"Referral"`
+	ReferralModel Referral `gorm:"foreignKey:Referral;references:Id" json:"-"`
+	FromHospital  string
+	ToHospital    string
+	Reason        string
+	// Receipt of the forwarding hospital if it had received the payload
+	Receipt            string
+	ReceiptSignature   string
+	ReceiptCertificate string
+	Created            int64 `gorm:"autoCreateTime"`
+}
+
+// Last change sequence a client's polling handler processed
+type PollCursor struct {
+	Direction string `gorm:"primaryKey"` // incoming or outgoing
+	Seq       int64
+}
+
+// Failed upload attempts of a client's outgoing referral, kept across restarts
+type UploadFailure struct {
+	Referral int `gorm:"primaryKey;autoIncrement:false"`
+	Count    int
+}
+
+// One status change of a referral, FromStatus is empty for the creation
+type ReferralEvent struct {
+	Id            int      `gorm:"primaryKey;autoIncrement"`
+	Referral      int      `json:"Referral"`
+	ReferralModel Referral `gorm:"foreignKey:Referral;references:Id" json:"-"`
+	FromStatus    ReferralStatus
+	ToStatus      ReferralStatus
+	Actor         string // Origin, Destination, Patient or System
+	ActorId       string // hospital id or patient username
+	Details       string
+	Created       int64 `gorm:"autoCreateTime"`
+}
+
+// Referral event queued for a hospital's webhook, kept as the delivery log
+type WebhookDelivery struct {
+	Id          int `gorm:"primaryKey;autoIncrement"`
+	HospitalId  string
+	Event       int
+	EventModel  ReferralEvent `gorm:"foreignKey:Event;references:Id" json:"-"`
+	Referral    int
+	Status      DeliveryStatus
+	Attempts    int
+	NextAttempt int64 // unix time
+	LastAttempt int64
+	LastCode    int // response status, 0 if there was no response
+	LastError   string
+	Created     int64 `gorm:"autoCreateTime"`
 }
 
 // Database Management
@@ -160,22 +353,71 @@ func NewDatabase(dbname string) (database Database) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// sqlite allows one writer, handlers run concurrently
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
 	db.AutoMigrate(&File{})
 	db.AutoMigrate(&Referral{})
 	db.AutoMigrate(&ReferralReceipt{})
 	db.AutoMigrate(&Hospital{})
 	db.AutoMigrate(&Patient{})
+	db.AutoMigrate(&FileChunk{})
+	db.AutoMigrate(&ReferralEvent{})
+	db.AutoMigrate(&ReferralForward{})
+	db.AutoMigrate(&ReferralCandidate{})
+	db.AutoMigrate(&PollCursor{})
+	db.AutoMigrate(&UploadFailure{})
+	db.AutoMigrate(&WebhookDelivery{})
 	// db.AutoMigrate(&ClientAccount{})
+	// referrals from before the change sequence
+	db.Model(&Referral{}).Where("seq IS NULL OR seq = 0").Update("seq", gorm.Expr("id"))
 
 	fillTestData(db)
 
-	return Database{database: db}
+	return Database{database: db, changes: &changeSignal{ch: make(chan struct{})}}
+}
+
+// Closed once the change sequence moves, take it before reading so no change is missed
+func (db *Database) Changes() <-chan struct{} {
+	if db.changes == nil {
+		return nil
+	}
+	return db.changes.wait()
+}
+
+// Called with the outcome of every write that raises the change sequence
+func (db *Database) notifyChange(ok bool) bool {
+	if ok && db.changes != nil {
+		db.changes.notify()
+	}
+	return ok
+}
+
+// Next value of the change sequence, taken inside the writing statement.
+// sqlite runs one writer at a time so the sequence only goes up
+var nextSeq = gorm.Expr("(SELECT COALESCE(MAX(seq), 0) + 1 FROM referrals)")
+
+func touchReferral(tx *gorm.DB, referralId int) error {
+	return tx.Model(&Referral{Id: referralId}).Update("seq", nextSeq).Error
+}
+
+func (db *Database) createReferral(referral *Referral) error {
+	err := db.database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Id").Create(referral).Error; err != nil {
+			return err
+		}
+		return touchReferral(tx, referral.Id)
+	})
+	db.notifyChange(err == nil)
+	return err
 }
 
 func (db *Database) CreateReferralServer(referral Referral) (id int, ok bool) {
 	referral.ReferralStatus = Created
-	result := db.database.Omit("Id").Create(&referral)
-	if result.Error != nil {
+	if err := db.createReferral(&referral); err != nil {
 		return 0, false
 	}
 	return referral.Id, true
@@ -226,13 +468,22 @@ func (db *Database) GetReceiptByReferral(referralId int) (r ReferralReceipt, ok
 	return r, true
 }
 
-func (db *Database) GetReferralsByDestination(hospitalId string) (r []Referral) {
-	db.database.Where("destination = ?", hospitalId).Find(&r)
+// Referrals changed after since, in change order
+func (db *Database) GetReferralsByDestination(hospitalId string, since int64) (r []Referral) {
+	db.database.Where("destination = ? AND seq > ?", hospitalId, since).Order("seq").Find(&r)
 	return
 }
 
-func (db *Database) GetReferralsByOrigin(hospitalId string) (r []Referral) {
-	db.database.Where("origin = ?", hospitalId).Find(&r)
+// Counter-referral skips consent and grant, the origin already referred the patient
+func (db *Database) CreateCounterReferral(referral Referral) (id int, ok bool) {
+	referral.ReferralStatus = CounterCreated
+	if err := db.createReferral(&referral); err != nil {
+		return 0, false
+	}
+	return referral.Id, true
+}
+func (db *Database) GetReferralsByOrigin(hospitalId string, since int64) (r []Referral) {
+	db.database.Where("origin = ? AND seq > ?", hospitalId, since).Order("seq").Find(&r)
 	return
 }
 
@@ -255,11 +506,149 @@ func (db *Database) GetReferralById(id int) (r Referral, ok bool) {
 }
 
 func (db *Database) UpdateStatusReferralById(id int, status ReferralStatus) (ok bool) {
-	result := db.database.Model(&Referral{Id: id}).Update("referral_status", status)
+	result := db.database.Model(&Referral{Id: id}).Updates(map[string]interface{}{
+		"referral_status": status,
+		"seq":             nextSeq,
+	})
 	if result.RowsAffected == 0 {
 		return false
 	}
-	return result.Error == nil
+	return db.notifyChange(result.Error == nil)
+}
+
+// Sets the status only while it is still from, false if another request changed it first.
+// The check and the update are one statement, so concurrent transitions cannot both pass
+func (db *Database) TransitionReferral(id int, from ReferralStatus, to ReferralStatus) (ok bool) {
+	return db.TransitionReferralEvent(ReferralEvent{Referral: id, FromStatus: from, ToStatus: to})
+}
+
+// Like TransitionReferral, the event is stored with the new status and not at all on conflict
+func (db *Database) TransitionReferralEvent(event ReferralEvent) (ok bool) {
+	return db.TransitionReferralUpdates(event, nil)
+}
+
+// Like TransitionReferralEvent, other referral columns are updated together with the status
+func (db *Database) TransitionReferralUpdates(event ReferralEvent, updates map[string]interface{}) (ok bool) {
+	return db.TransitionReferralEffects(event, updates, nil) == nil
+}
+
+var ErrStatusChanged = errors.New("referral status changed")
+
+// Like TransitionReferralUpdates, effects run on a Database bound to the transaction
+// so their writes are kept only with the new status; ErrStatusChanged on conflict
+func (db *Database) TransitionReferralEffects(event ReferralEvent, updates map[string]interface{},
+	effects []func(tx *Database) error) error {
+	// a status entered again is watched again
+	columns := map[string]interface{}{"referral_status": event.ToStatus, "escalated": "", "seq": nextSeq}
+	for column, value := range updates {
+		columns[column] = value
+	}
+	err := db.database.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Referral{}).
+			Where("id = ? AND referral_status = ?", event.Referral, event.FromStatus).
+			Updates(columns)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrStatusChanged
+		}
+		if err := tx.Omit("Id").Create(&event).Error; err != nil {
+			return err
+		}
+		for _, effect := range effects {
+			if err := effect(&Database{database: tx}); err != nil {
+				return err
+			}
+		}
+		return enqueueWebhooks(tx, event)
+	})
+	db.notifyChange(err == nil)
+	return err
+}
+
+func (db *Database) CreateReferralEvent(event ReferralEvent) (ok bool) {
+	err := db.database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Id").Create(&event).Error; err != nil {
+			return err
+		}
+		return enqueueWebhooks(tx, event)
+	})
+	return err == nil
+}
+
+// Queues the event for every hospital on the referral with a webhook,
+// in the event's transaction so no event is stored without its deliveries
+func enqueueWebhooks(tx *gorm.DB, event ReferralEvent) error {
+	referral := Referral{}
+	if err := tx.Where("id = ?", event.Referral).First(&referral).Error; err != nil {
+		return err
+	}
+	hospitalIds := []string{referral.Origin, referral.Destination}
+	var candidates []string
+	if err := tx.Model(&ReferralCandidate{}).Where("referral = ?", referral.Id).Pluck("hospital_id", &candidates).Error; err != nil {
+		return err
+	}
+	hospitalIds = append(hospitalIds, candidates...)
+	var hospitals []Hospital
+	err := tx.Where("hospital_id IN ? AND webhook_url IS NOT NULL AND webhook_url <> ''", hospitalIds).Find(&hospitals).Error
+	if err != nil {
+		return err
+	}
+	for _, hospital := range hospitals {
+		delivery := WebhookDelivery{
+			HospitalId:  hospital.HospitalId,
+			Event:       event.Id,
+			Referral:    referral.Id,
+			Status:      DeliveryPending,
+			NextAttempt: event.Created,
+		}
+		if err := tx.Omit("Id").Create(&delivery).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unix time the referral entered its current status
+func (db *Database) GetStatusSince(referral Referral) int64 {
+	var event ReferralEvent
+	result := db.database.
+		Where("referral = ? AND to_status = ? AND from_status <> to_status", referral.Id, referral.ReferralStatus).
+		Order("id desc").Limit(1).Find(&event)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return referral.Created
+	}
+	return event.Created
+}
+
+// Marks the referral escalated in its current status and stores the event,
+// false if it already was or the status changed
+func (db *Database) EscalateReferral(event ReferralEvent) (ok bool) {
+	err := db.database.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Referral{}).
+			Where("id = ? AND referral_status = ? AND (escalated IS NULL OR escalated <> ?)", event.Referral, event.ToStatus, event.ToStatus).
+			Update("escalated", event.ToStatus)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Omit("Id").Create(&event).Error; err != nil {
+			return err
+		}
+		return enqueueWebhooks(tx, event)
+	})
+	return err == nil
+}
+
+func (db *Database) GetEventsByReferral(referralId int) (events []ReferralEvent, ok bool) {
+	result := db.database.Where("referral = ?", referralId).Order("id").Find(&events)
+	if result.Error != nil {
+		return events, false
+	}
+	return events, true
 }
 
 func (db *Database) ServerCreateFile(file File) (id int, ok bool) {
@@ -278,6 +667,96 @@ func (db *Database) ClientCreateFile(file File) (id int, ok bool) {
 	return file.Id, true
 }
 
+// Records a step in a referral's forwarding chain
+func (db *Database) CreateReferralForward(forward ReferralForward) (ok bool) {
+	result := db.database.Omit("Id").Create(&forward)
+	return result.Error == nil
+}
+
+func (db *Database) CreateReferralCandidates(candidates []ReferralCandidate) (ok bool) {
+	if len(candidates) == 0 {
+		return true
+	}
+	err := db.database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Id").Create(&candidates).Error; err != nil {
+			return err
+		}
+		return touchReferral(tx, candidates[0].Referral)
+	})
+	return db.notifyChange(err == nil)
+}
+
+func (db *Database) GetCandidatesByReferral(referralId int) (candidates []ReferralCandidate, ok bool) {
+	result := db.database.Where("referral = ?", referralId).Order("id").Find(&candidates)
+	if result.Error != nil {
+		return candidates, false
+	}
+	return candidates, true
+}
+
+func (db *Database) GetCandidate(referralId int, hospitalId string) (candidate ReferralCandidate, ok bool) {
+	result := db.database.Where("referral = ? AND hospital_id = ?", referralId, hospitalId).First(&candidate)
+	if result.Error != nil {
+		return candidate, false
+	}
+	return candidate, true
+}
+
+// Referrals broadcast to the hospital
+func (db *Database) GetReferralsByCandidate(hospitalId string, since int64) (r []Referral) {
+	db.database.Where("id IN (?) AND seq > ?", db.database.Model(&ReferralCandidate{}).Select("referral").Where("hospital_id = ?", hospitalId), since).
+		Order("seq").Find(&r)
+	return
+}
+
+func (db *Database) DeclineCandidate(referralId int, hospitalId string, code DeclineCode, reason string) (ok bool) {
+	err := db.database.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&ReferralCandidate{}).
+			Where("referral = ? AND hospital_id = ? AND status = ?", referralId, hospitalId, CandidatePending).
+			Updates(map[string]interface{}{
+				"status":         CandidateDeclined,
+				"decline_code":   code,
+				"decline_reason": reason,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return touchReferral(tx, referralId)
+	})
+	return db.notifyChange(err == nil)
+}
+
+// Winner is claimed, candidates still waiting are told the referral is gone
+func (db *Database) CloseCandidates(referralId int, winner string) (ok bool) {
+	err := db.database.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&ReferralCandidate{}).
+			Where("referral = ? AND hospital_id = ?", referralId, winner).
+			Update("status", CandidateClaimed).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&ReferralCandidate{}).
+			Where("referral = ? AND hospital_id <> ? AND status = ?", referralId, winner, CandidatePending).
+			Update("status", CandidateUnavailable).Error
+		if err != nil {
+			return err
+		}
+		return touchReferral(tx, referralId)
+	})
+	return db.notifyChange(err == nil)
+}
+
+func (db *Database) GetForwardsByReferral(referralId int) (forwards []ReferralForward, ok bool) {
+	result := db.database.Where("referral = ?", referralId).Order("id").Find(&forwards)
+	if result.Error != nil {
+		return forwards, false
+	}
+	return forwards, true
+}
+
 func (db *Database) GetFilesByReferral(id int) (fs []File, ok bool) {
 	result := db.database.Where("referral = ?", id).Find(&fs)
 	if result.Error != nil {
@@ -302,14 +781,101 @@ func (db *Database) UpdateStatusFileById(id int, status UploadStatus) (ok bool)
 	return result.Error == nil
 }
 
+func (db *Database) UpdateDownloadStatusFileById(id int, status DownloadStatus) (ok bool) {
+	result := db.database.Model(&File{Id: id}).Update("download_status", status)
+	if result.RowsAffected == 0 {
+		return false
+	}
+	return result.Error == nil
+}
+
 func (db *Database) UpdatePayloadKeyById(id int, payloadKey string) (ok bool) {
-	result := db.database.Model(&Referral{Id: id}).Update("payload_key", payloadKey)
+	result := db.database.Model(&Referral{Id: id}).Updates(map[string]interface{}{
+		"payload_key": payloadKey,
+		"seq":         nextSeq,
+	})
+	if result.RowsAffected == 0 {
+		return false
+	}
+	return db.notifyChange(result.Error == nil)
+}
+
+func (db *Database) UpdateManifestById(id int, manifest string, signature string) (ok bool) {
+	result := db.database.Model(&Referral{Id: id}).Updates(map[string]interface{}{
+		"manifest":           manifest,
+		"manifest_signature": signature,
+		"seq":                nextSeq,
+	})
+	if result.RowsAffected == 0 {
+		return false
+	}
+	return db.notifyChange(result.Error == nil)
+}
+
+func (db *Database) CreateChunkFiles(referralId int, chunkFiles []ChunkFile) (ok bool) {
+	err := db.database.Transaction(func(tx *gorm.DB) error {
+		for _, cf := range chunkFiles {
+			for i, chunk := range cf.Chunks {
+				fc := FileChunk{
+					Referral:   referralId,
+					FileName:   cf.Name,
+					ChunkIndex: i,
+					Chunk:      chunk,
+				}
+				if err := tx.Omit("Id").Create(&fc).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return err == nil
+}
+
+func (db *Database) GetChunkFilesByReferral(referralId int) (cfs []ChunkFile, ok bool) {
+	fcs := []FileChunk{}
+	result := db.database.Where("referral = ?", referralId).Order("file_name, chunk_index").Find(&fcs)
+	if result.Error != nil {
+		return cfs, false
+	}
+	for _, fc := range fcs {
+		if len(cfs) == 0 || cfs[len(cfs)-1].Name != fc.FileName {
+			cfs = append(cfs, ChunkFile{Name: fc.FileName})
+		}
+		cfs[len(cfs)-1].Chunks = append(cfs[len(cfs)-1].Chunks, fc.Chunk)
+	}
+	return cfs, true
+}
+
+func (db *Database) GetChunk(referralId int, name string, chunkIndex int) (c Chunk, ok bool) {
+	fc := FileChunk{}
+	result := db.database.Where("referral = ? and file_name = ? and chunk_index = ?", referralId, name, chunkIndex).First(&fc)
+	if result.Error != nil {
+		return c, false
+	}
+	return fc.Chunk, true
+}
+
+func (db *Database) UpdateStatusChunk(referralId int, name string, chunkIndex int, status ChunkStatus) (ok bool) {
+	result := db.database.Model(&FileChunk{}).
+		Where("referral = ? and file_name = ? and chunk_index = ?", referralId, name, chunkIndex).
+		Update("status", status)
 	if result.RowsAffected == 0 {
 		return false
 	}
 	return result.Error == nil
 }
 
+func (db *Database) DeleteChunksByReferral(referralId int) (ok bool) {
+	result := db.database.Where("referral = ?", referralId).Delete(&FileChunk{})
+	return result.Error == nil
+}
+
+func (db *Database) DeleteFilesByReferral(referralId int) (ok bool) {
+	result := db.database.Where("referral = ?", referralId).Delete(&File{})
+	return result.Error == nil
+}
+
 func (db *Database) ServerCreateHospital(hos Hospital) (id int, ok bool) {
 	result := db.database.Omit("Id").Create(&hos)
 	if result.Error != nil {
@@ -326,6 +892,73 @@ func (db *Database) GetHospitalBySerial(serial string) (hos Hospital, ok bool) {
 	return hos, true
 }
 
+func (db *Database) GetHospitalByHospitalId(hospitalId string) (hos Hospital, ok bool) {
+	result := db.database.Where("hospital_id = ?", hospitalId).First(&hos)
+	if result.Error != nil {
+		return hos, false
+	}
+	return hos, true
+}
+
+func (db *Database) UpdateHospitalCertificate(id int, certificate string) (ok bool) {
+	result := db.database.Model(&Hospital{Id: id}).Update("certificate", certificate)
+	if result.RowsAffected == 0 {
+		return false
+	}
+	return result.Error == nil
+}
+
+// Empty url removes the webhook
+func (db *Database) UpdateHospitalWebhook(hospitalId string, url string, secret string) (ok bool) {
+	result := db.database.Model(&Hospital{}).Where("hospital_id = ?", hospitalId).Updates(map[string]interface{}{
+		"webhook_url":    url,
+		"webhook_secret": secret,
+	})
+	if result.RowsAffected == 0 {
+		return false
+	}
+	return result.Error == nil
+}
+
+func (db *Database) GetEventById(id int) (event ReferralEvent, ok bool) {
+	result := db.database.Where("id = ?", id).First(&event)
+	if result.Error != nil {
+		return event, false
+	}
+	return event, true
+}
+
+// Pending deliveries whose next attempt is due, oldest first
+func (db *Database) GetDueDeliveries(now int64, limit int) (deliveries []WebhookDelivery) {
+	db.database.Where("status = ? AND next_attempt <= ?", DeliveryPending, now).Order("id").Limit(limit).Find(&deliveries)
+	return
+}
+
+// Stores the outcome of a delivery attempt
+func (db *Database) UpdateDelivery(delivery WebhookDelivery) (ok bool) {
+	result := db.database.Model(&WebhookDelivery{Id: delivery.Id}).Updates(map[string]interface{}{
+		"status":       delivery.Status,
+		"attempts":     delivery.Attempts,
+		"next_attempt": delivery.NextAttempt,
+		"last_attempt": delivery.LastAttempt,
+		"last_code":    delivery.LastCode,
+		"last_error":   delivery.LastError,
+	})
+	if result.RowsAffected == 0 {
+		return false
+	}
+	return result.Error == nil
+}
+
+// Newest first
+func (db *Database) GetDeliveriesByHospital(hospitalId string, limit int) (deliveries []WebhookDelivery, ok bool) {
+	result := db.database.Where("hospital_id = ?", hospitalId).Order("id desc").Limit(limit).Find(&deliveries)
+	if result.Error != nil {
+		return deliveries, false
+	}
+	return deliveries, true
+}
+
 func (db *Database) GetHospitals() (hos []Hospital, ok bool) {
 	result := db.database.Find(&hos)
 	if result.RowsAffected == 0 {
@@ -334,6 +967,43 @@ func (db *Database) GetHospitals() (hos []Hospital, ok bool) {
 	return hos, true
 }
 
+func (db *Database) GetCounterReferrals(referralId int) (r []Referral) {
+	db.database.Where("counter_to = ?", referralId).Find(&r)
+	return
+}
+
+// 0 if the direction was never polled
+func (db *Database) GetPollCursor(direction string) (seq int64) {
+	cursor := PollCursor{}
+	db.database.Where("direction = ?", direction).Limit(1).Find(&cursor)
+	return cursor.Seq
+}
+
+func (db *Database) SetPollCursor(direction string, seq int64) (ok bool) {
+	result := db.database.Save(&PollCursor{Direction: direction, Seq: seq})
+	return result.Error == nil
+}
+
+func (db *Database) GetUploadFailures(referralId int) (count int) {
+	failure := UploadFailure{}
+	db.database.Where("referral = ?", referralId).Limit(1).Find(&failure)
+	return failure.Count
+}
+
+// 0 forgets the referral's failures
+func (db *Database) SetUploadFailures(referralId int, count int) (ok bool) {
+	if count == 0 {
+		return db.database.Delete(&UploadFailure{}, "referral = ?", referralId).Error == nil
+	}
+	result := db.database.Save(&UploadFailure{Referral: referralId, Count: count})
+	return result.Error == nil
+}
+
+func (db *Database) GetReferralsByStatus(statuses []ReferralStatus) (r []Referral) {
+	db.database.Where("referral_status IN ?", statuses).Find(&r)
+	return
+}
+
 func (db *Database) GetReferralsByPatient(citizenId string) (r []Referral) {
 	db.database.Where("citizen_id = ?", citizenId).Find(&r)
 	return
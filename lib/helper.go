@@ -22,6 +22,7 @@ type Requester interface {
 	MakeJsonRequestRaw(URL string, body string) (io.ReadCloser, int, error)
 	MakeGetRequest(URL string) (string, int, error)
 	MakeGetRequestRaw(URL string) (io.ReadCloser, int, error)
+	MakeGetRangeRequestRaw(URL string, offset int64, ifRange string) (io.ReadCloser, int, error)
 	MakePostBinary(URL string, bodyReader io.Reader) (string, int, error)
 	MakePostBinaryRaw(URL string, bodyReader io.Reader) (io.ReadCloser, int, error)
 }
@@ -43,6 +44,15 @@ func GetEnvAsInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
+func GetEnvAsBool(key string, defaultVal bool) bool {
+	valueStr := GetEnv(key, "")
+	if value, err := strconv.ParseBool(valueStr); err == nil {
+		return value
+	}
+
+	return defaultVal
+}
+
 func LoadCert(own_crt string, own_key string) (cert tls.Certificate, err error) {
 	cert, err = tls.LoadX509KeyPair(own_crt, own_key)
 	if err != nil {
@@ -54,10 +64,12 @@ func LoadCert(own_crt string, own_key string) (cert tls.Certificate, err error)
 func LoadPool(ca_crt string) (caCertPool *x509.CertPool, err error) {
 	caCert, err := os.ReadFile(ca_crt)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
 	caCertPool = x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("could not load CA certificates from %s", ca_crt)
+	}
 	return
 }
 
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Payload keys are wrapped for the destination hospital, keys without the prefix are plain hex
+const WrappedKeyPrefix = "rsa-oaep-sha256:"
+
+// Entry of the server's key directory
+type HospitalKey = struct {
+	HospitalId  string `json:"HospitalId" validate:"required"`
+	CertSerial  string `json:"CertSerial"`
+	Certificate string `json:"Certificate" validate:"required"`
+}
+
+func EncodeCertificatePEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	}))
+}
+
+func ParseCertificatePEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("could not decode certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Checks the certificate is a client certificate signed by the CA
+func VerifyCertificate(cert *x509.Certificate, caCertPool *x509.CertPool) error {
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     caCertPool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// Whether the certificate was issued to the hospital, by Subject CN or a DNS SAN
+func CertificateIdentifies(cert *x509.Certificate, hospitalId string) bool {
+	return cert.Subject.CommonName == hospitalId || slices.Contains(cert.DNSNames, hospitalId)
+}
+
+func WrapKey(cert *x509.Certificate, key []byte) (string, error) {
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return "", err
+	}
+	return WrappedKeyPrefix + base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func UnwrapKey(privateKey crypto.PrivateKey, wrappedKey string) ([]byte, error) {
+	encoded, isWrapped := strings.CutPrefix(wrappedKey, WrappedKeyPrefix)
+	if !isWrapped {
+		// referrals uploaded before wrapping
+		return hex.DecodeString(wrappedKey)
+	}
+	rsaKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaKey, wrapped, nil)
+}
+
+// Certificate of a hospital from the server's key directory, checked against the CA
+// so the server cannot hand out a key it made itself, and against the hospital id
+// so it cannot hand out another hospital's key
+func FetchHospitalCertificate(client Requester, serverURL string, caFile string, hospitalId string) (*x509.Certificate, error) {
+	keys := []HospitalKey{}
+	resp, code, err := client.MakeGetRequestRaw(serverURL + "/hospitals/keys")
+	if err != nil {
+		return nil, err
+	}
+	if code != 200 {
+		return nil, fmt.Errorf("could not get hospital keys: %d", code)
+	}
+	defer resp.Close()
+	// the directory is a list, the validator only checks structs
+	err = json.NewDecoder(resp).Decode(&keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode hospital keys: %s", err)
+	}
+	idx := slices.IndexFunc(keys, func(k HospitalKey) bool {
+		return k.HospitalId == hospitalId
+	})
+	if idx < 0 {
+		return nil, fmt.Errorf("no key for hospital '%s'", hospitalId)
+	}
+	cert, err := ParseCertificatePEM(keys[idx].Certificate)
+	if err != nil {
+		return nil, err
+	}
+	caCertPool, err := LoadPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = VerifyCertificate(cert, caCertPool); err != nil {
+		return nil, fmt.Errorf("hospital '%s' certificate: %s", hospitalId, err)
+	}
+	if !CertificateIdentifies(cert, hospitalId) {
+		return nil, fmt.Errorf("hospital '%s' certificate is issued to '%s'", hospitalId, cert.Subject.CommonName)
+	}
+	return cert, nil
+}
@@ -0,0 +1,40 @@
+package lib
+
+import (
+	"crypto"
+	"maps"
+)
+
+type ManifestFile = struct {
+	Name     string `json:"Name" validate:"required"`
+	Checksum string `json:"Checksum" validate:"required"`
+}
+
+// Files of a referral payload as the origin encrypted them, signed by the origin
+type Manifest struct {
+	ReferralId int            `json:"ReferralId" validate:"required"`
+	Origin     string         `json:"Origin" validate:"required"`
+	Files      []ManifestFile `json:"Files" validate:"required,unique=Name,dive"`
+}
+
+// File name to checksum
+func fileChecksums(files []ManifestFile) map[string]string {
+	checksums := make(map[string]string, len(files))
+	for _, file := range files {
+		checksums[file.Name] = file.Checksum
+	}
+	return checksums
+}
+
+func (m Manifest) Matches(checksums map[string]string) bool {
+	return maps.Equal(fileChecksums(m.Files), checksums)
+}
+
+func SignManifest(privateKey crypto.PrivateKey, manifest Manifest) (manifestJson string, signature string, err error) {
+	return signJSON(privateKey, manifest)
+}
+
+func ParseManifest(manifestJson string) (manifest Manifest, err error) {
+	err = decodeStatement(manifestJson, &manifest)
+	return
+}
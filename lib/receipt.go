@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/x509"
+	"maps"
+)
+
+// Destination's statement that it received and verified the referral files
+type Receipt struct {
+	ReferralId  int            `json:"ReferralId" validate:"required"`
+	Destination string         `json:"Destination" validate:"required"`
+	Files       []ManifestFile `json:"Files" validate:"required,unique=Name,dive"`
+	Timestamp   int64          `json:"Timestamp" validate:"required"`
+}
+
+func (r Receipt) Matches(checksums map[string]string) bool {
+	return maps.Equal(fileChecksums(r.Files), checksums)
+}
+
+func SignReceipt(privateKey crypto.PrivateKey, receipt Receipt) (receiptJson string, signature string, err error) {
+	return signJSON(privateKey, receipt)
+}
+
+// Receipt is only decoded after its signature is checked
+func VerifyReceipt(cert *x509.Certificate, receiptJson string, signature string) (receipt Receipt, err error) {
+	if err = VerifySignature(cert, receiptJson, signature); err != nil {
+		return
+	}
+	err = decodeStatement(receiptJson, &receipt)
+	return
+}
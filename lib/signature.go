@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Signed statements are sent as their JSON text, so the signature does not depend on encoding
+func signJSON(privateKey crypto.PrivateKey, statement any) (statementJson string, signature string, err error) {
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return "", "", fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	data, err := json.Marshal(statement)
+	if err != nil {
+		return
+	}
+	digest := sha256.Sum256(data)
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return
+	}
+	return string(data), base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func VerifySignature(cert *x509.Certificate, statementJson string, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("could not decode signature: %s", err)
+	}
+	digest := sha256.Sum256([]byte(statementJson))
+	switch publicKey := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(publicKey, digest[:], sig) {
+			return fmt.Errorf("ecdsa: verification error")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+	}
+}
+
+func decodeStatement(statementJson string, statement any) error {
+	return DecodeValidate(statement, io.NopCloser(strings.NewReader(statementJson)))
+}
@@ -0,0 +1,189 @@
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	db "simplemts/lib/database"
+)
+
+// Who triggers a transition
+type Actor string
+
+const (
+	Origin      Actor = "Origin"
+	Destination Actor = "Destination"
+	Patient     Actor = "Patient"
+	System      Actor = "System" // scheduled jobs on the central server
+)
+
+// Who triggers a transition and why, kept in the referral history
+type Trigger struct {
+	Actor   Actor
+	ActorId string // hospital id or patient username
+	Details string
+	// Referral columns stored together with the new status
+	Updates map[string]interface{}
+	// Work of this call, run after the transition's effects in the same transaction
+	Effects []Effect
+}
+
+var (
+	ErrIllegalTransition = errors.New("illegal transition")
+	ErrForbidden         = errors.New("not allowed to trigger transition")
+	ErrConflict          = errors.New("referral status changed")
+)
+
+// Database work that belongs to a transition, run in the transaction that stores the new status
+type Effect func(database *db.Database, referralId int) error
+
+type Transition struct {
+	From    db.ReferralStatus
+	To      db.ReferralStatus
+	Actor   Actor
+	Effects []Effect
+}
+
+var Transitions = []Transition{
+	{From: db.Created, To: db.Consented, Actor: Patient},
+	{From: db.Consented, To: db.Granted, Actor: Destination},
+	{From: db.Consented, To: db.NotGranted, Actor: Destination},
+	{From: db.Granted, To: db.UploadIncomplete, Actor: Origin},
+	{From: db.UploadIncomplete, To: db.UploadComplete, Actor: Origin},
+	// aborted upload, origin can initiate again
+	{From: db.UploadIncomplete, To: db.Granted, Actor: Origin, Effects: []Effect{ResetUpload}},
+	{From: db.UploadComplete, To: db.Complete, Actor: Destination},
+	{From: db.UploadComplete, To: db.Rejected, Actor: Destination},
+	// origin withdraws the referral, anything uploaded is purged
+	{From: db.Created, To: db.Cancelled, Actor: Origin},
+	{From: db.Consented, To: db.Cancelled, Actor: Origin},
+	{From: db.Granted, To: db.Cancelled, Actor: Origin, Effects: []Effect{ResetUpload}},
+	{From: db.UploadIncomplete, To: db.Cancelled, Actor: Origin, Effects: []Effect{ResetUpload}},
+	{From: db.UploadComplete, To: db.Cancelled, Actor: Origin, Effects: []Effect{ResetUpload}},
+	// destination sends the referral on, the patient consents to the new destination and it grants;
+	// a payload the previous destination had received goes on without a new upload
+	{From: db.Consented, To: db.Forwarded, Actor: Destination},
+	{From: db.Complete, To: db.Forwarded, Actor: Destination},
+	{From: db.Forwarded, To: db.Consented, Actor: Patient},
+	{From: db.Granted, To: db.UploadComplete, Actor: Destination},
+	{From: db.Forwarded, To: db.Cancelled, Actor: Origin, Effects: []Effect{ResetUpload}},
+	// counter-referral, origin is the hospital sending results back
+	{From: db.CounterCreated, To: db.CounterUploadIncomplete, Actor: Origin},
+	{From: db.CounterUploadIncomplete, To: db.CounterUploadComplete, Actor: Origin},
+	{From: db.CounterUploadIncomplete, To: db.CounterCreated, Actor: Origin, Effects: []Effect{ResetUpload}},
+	{From: db.CounterUploadComplete, To: db.CounterComplete, Actor: Destination},
+	{From: db.CounterUploadComplete, To: db.Rejected, Actor: Destination},
+	{From: db.CounterCreated, To: db.Cancelled, Actor: Origin},
+	{From: db.CounterUploadIncomplete, To: db.Cancelled, Actor: Origin, Effects: []Effect{ResetUpload}},
+	{From: db.CounterUploadComplete, To: db.Cancelled, Actor: Origin, Effects: []Effect{ResetUpload}},
+	// nobody acted in time, closed by the SLA monitor
+	{From: db.Created, To: db.Expired, Actor: System},
+	{From: db.Consented, To: db.Expired, Actor: System},
+	{From: db.Granted, To: db.Expired, Actor: System},
+}
+
+// Statuses a payload goes through, the upload handlers work the same for both flows
+type UploadFlow struct {
+	Ready      db.ReferralStatus // origin can initiate the upload
+	Uploading  db.ReferralStatus
+	Uploaded   db.ReferralStatus // destination can download
+	Downloaded db.ReferralStatus
+}
+
+var (
+	ReferralFlow = UploadFlow{db.Granted, db.UploadIncomplete, db.UploadComplete, db.Complete}
+	CounterFlow  = UploadFlow{db.CounterCreated, db.CounterUploadIncomplete, db.CounterUploadComplete, db.CounterComplete}
+)
+
+func Flow(referral db.Referral) UploadFlow {
+	if referral.CounterTo != 0 {
+		return CounterFlow
+	}
+	return ReferralFlow
+}
+
+// Removes upload tracking, files, payload key and manifest of a referral
+func ResetUpload(database *db.Database, referralId int) error {
+	if !database.DeleteChunksByReferral(referralId) {
+		return fmt.Errorf("could not release tracking")
+	}
+	if !database.DeleteFilesByReferral(referralId) {
+		return fmt.Errorf("could not reset files")
+	}
+	if !database.UpdatePayloadKeyById(referralId, "") {
+		return fmt.Errorf("could not reset payload key")
+	}
+	if !database.UpdateManifestById(referralId, "", "") {
+		return fmt.Errorf("could not reset manifest")
+	}
+	return nil
+}
+
+// Hospital's side of a referral, false if the hospital is not part of it
+func HospitalActor(referral db.Referral, hospitalId string) (Actor, bool) {
+	switch hospitalId {
+	case referral.Origin:
+		return Origin, true
+	case referral.Destination:
+		return Destination, true
+	}
+	return "", false
+}
+
+func Find(from db.ReferralStatus, to db.ReferralStatus, actor Actor) (Transition, error) {
+	legal := false
+	for _, transition := range Transitions {
+		if transition.From != from || transition.To != to {
+			continue
+		}
+		legal = true
+		if transition.Actor == actor {
+			return transition, nil
+		}
+	}
+	if legal {
+		return Transition{}, fmt.Errorf("%w: %s cannot set %s to %s", ErrForbidden, actor, from, to)
+	}
+	return Transition{}, fmt.Errorf("%w: referral is in state %s, cannot set to %s", ErrIllegalTransition, from, to)
+}
+
+// Checks the transition from the referral's status, stores the new status and its event
+// if nobody changed it since the referral was read; the transition's effects run in the
+// same transaction, so a failed effect leaves the referral as it was
+func Apply(database *db.Database, referral db.Referral, trigger Trigger, to db.ReferralStatus) error {
+	transition, err := Find(referral.ReferralStatus, to, trigger.Actor)
+	if err != nil {
+		return err
+	}
+	effects := []func(tx *db.Database) error{}
+	for _, effect := range append(append([]Effect{}, transition.Effects...), trigger.Effects...) {
+		effect := effect
+		effects = append(effects, func(tx *db.Database) error {
+			return effect(tx, referral.Id)
+		})
+	}
+	err = database.TransitionReferralEffects(db.ReferralEvent{
+		Referral:   referral.Id,
+		FromStatus: referral.ReferralStatus,
+		ToStatus:   to,
+		Actor:      string(trigger.Actor),
+		ActorId:    trigger.ActorId,
+		Details:    trigger.Details,
+	}, trigger.Updates, effects)
+	if errors.Is(err, db.ErrStatusChanged) {
+		return fmt.Errorf("%w: referral is no longer %s", ErrConflict, referral.ReferralStatus)
+	}
+	return err
+}
+
+// Response code for an Apply error
+func HTTPStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrIllegalTransition), errors.Is(err, ErrForbidden):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
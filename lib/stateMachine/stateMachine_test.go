@@ -0,0 +1,267 @@
+package statemachine_test
+
+import (
+	"errors"
+	"fmt"
+	db "simplemts/lib/database"
+	statemachine "simplemts/lib/stateMachine"
+	testhelper "simplemts/lib/testHelper"
+	"slices"
+	"sync"
+	"testing"
+)
+
+var database = db.NewDatabase("../../testing_statemachine.sqlite")
+
+var statuses = []db.ReferralStatus{
+	db.Created, db.Consented, db.Granted, db.UploadIncomplete, db.UploadComplete,
+	db.Complete, db.NotGranted, db.Rejected, db.Cancelled,
+	db.CounterCreated, db.CounterUploadIncomplete, db.CounterUploadComplete, db.CounterComplete,
+	db.Forwarded, db.Expired,
+}
+
+var actors = []statemachine.Actor{
+	statemachine.Origin, statemachine.Destination, statemachine.Patient, statemachine.System,
+}
+
+type transitionCase struct {
+	from  db.ReferralStatus
+	to    db.ReferralStatus
+	actor statemachine.Actor
+}
+
+func TestFind(t *testing.T) {
+	legal := map[transitionCase]bool{
+		{db.Created, db.Consented, statemachine.Patient}:              true,
+		{db.Consented, db.Granted, statemachine.Destination}:          true,
+		{db.Consented, db.NotGranted, statemachine.Destination}:       true,
+		{db.Granted, db.UploadIncomplete, statemachine.Origin}:        true,
+		{db.UploadIncomplete, db.UploadComplete, statemachine.Origin}: true,
+		{db.UploadIncomplete, db.Granted, statemachine.Origin}:        true,
+		{db.UploadComplete, db.Complete, statemachine.Destination}:    true,
+		{db.UploadComplete, db.Rejected, statemachine.Destination}:    true,
+		{db.Created, db.Cancelled, statemachine.Origin}:               true,
+		{db.Consented, db.Cancelled, statemachine.Origin}:             true,
+		{db.Granted, db.Cancelled, statemachine.Origin}:               true,
+		{db.UploadIncomplete, db.Cancelled, statemachine.Origin}:      true,
+		{db.UploadComplete, db.Cancelled, statemachine.Origin}:        true,
+		// forwarding
+		{db.Consented, db.Forwarded, statemachine.Destination}:    true,
+		{db.Complete, db.Forwarded, statemachine.Destination}:     true,
+		{db.Forwarded, db.Consented, statemachine.Patient}:        true,
+		{db.Granted, db.UploadComplete, statemachine.Destination}: true,
+		{db.Forwarded, db.Cancelled, statemachine.Origin}:         true,
+		// counter-referral
+		{db.CounterCreated, db.CounterUploadIncomplete, statemachine.Origin}:        true,
+		{db.CounterUploadIncomplete, db.CounterUploadComplete, statemachine.Origin}: true,
+		{db.CounterUploadIncomplete, db.CounterCreated, statemachine.Origin}:        true,
+		{db.CounterUploadComplete, db.CounterComplete, statemachine.Destination}:    true,
+		{db.CounterUploadComplete, db.Rejected, statemachine.Destination}:           true,
+		{db.CounterCreated, db.Cancelled, statemachine.Origin}:                      true,
+		{db.CounterUploadIncomplete, db.Cancelled, statemachine.Origin}:             true,
+		{db.CounterUploadComplete, db.Cancelled, statemachine.Origin}:               true,
+		// SLA monitor
+		{db.Created, db.Expired, statemachine.System}:   true,
+		{db.Consented, db.Expired, statemachine.System}: true,
+		{db.Granted, db.Expired, statemachine.System}:   true,
+	}
+	// edges someone may take, anyone else is forbidden
+	edges := map[[2]db.ReferralStatus]bool{}
+	for c := range legal {
+		edges[[2]db.ReferralStatus{c.from, c.to}] = true
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			for _, actor := range actors {
+				c := transitionCase{from, to, actor}
+				t.Run(fmt.Sprintf("%s %s to %s", actor, from, to), func(t *testing.T) {
+					_, err := statemachine.Find(from, to, actor)
+					switch {
+					case legal[c]:
+						if err != nil {
+							t.Errorf("Want legal, Got %s", err)
+						}
+					case edges[[2]db.ReferralStatus{from, to}]:
+						if !errors.Is(err, statemachine.ErrForbidden) {
+							t.Errorf("Want %s, Got %v", statemachine.ErrForbidden, err)
+						}
+					default:
+						if !errors.Is(err, statemachine.ErrIllegalTransition) {
+							t.Errorf("Want %s, Got %v", statemachine.ErrIllegalTransition, err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestHospitalActor(t *testing.T) {
+	referral := db.Referral{ReferralObject: db.ReferralObject{Origin: "1", Destination: "2"}}
+	tests := []struct {
+		hospitalId string
+		want       statemachine.Actor
+		wantOk     bool
+	}{
+		{"1", statemachine.Origin, true},
+		{"2", statemachine.Destination, true},
+		{"3", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := statemachine.HospitalActor(referral, tt.hospitalId)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("%s: Want %s %t, Got %s %t", tt.hospitalId, tt.want, tt.wantOk, got, ok)
+		}
+	}
+}
+
+func TestFlow(t *testing.T) {
+	if got := statemachine.Flow(db.Referral{}); got != statemachine.ReferralFlow {
+		t.Errorf("Want %v, Got %v", statemachine.ReferralFlow, got)
+	}
+	if got := statemachine.Flow(db.Referral{CounterTo: 1}); got != statemachine.CounterFlow {
+		t.Errorf("Want %v, Got %v", statemachine.CounterFlow, got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	t.Run("Consent after complete", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(&database)
+		database.UpdateStatusReferralById(referralId, db.Complete)
+		referral, _ := database.GetReferralById(referralId)
+		err := statemachine.Apply(&database, referral, statemachine.Trigger{Actor: statemachine.Patient}, db.Consented)
+		if !errors.Is(err, statemachine.ErrIllegalTransition) {
+			t.Errorf("Want %s, Got %v", statemachine.ErrIllegalTransition, err)
+		}
+		referral, _ = database.GetReferralById(referralId)
+		if referral.ReferralStatus != db.Complete {
+			t.Errorf("Want %s, Got %s", db.Complete, referral.ReferralStatus)
+		}
+	})
+	t.Run("Normal", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(&database)
+		referral, _ := database.GetReferralById(referralId)
+		trigger := statemachine.Trigger{Actor: statemachine.Patient, ActorId: "user", Details: "test"}
+		err := statemachine.Apply(&database, referral, trigger, db.Consented)
+		if err != nil {
+			t.Errorf("Apply error %s", err)
+		}
+		referral, _ = database.GetReferralById(referralId)
+		if referral.ReferralStatus != db.Consented {
+			t.Errorf("Want %s, Got %s", db.Consented, referral.ReferralStatus)
+		}
+		events, _ := database.GetEventsByReferral(referralId)
+		if len(events) != 1 {
+			t.Fatalf("Want 1 event, Got %d", len(events))
+		}
+		event := events[0]
+		if event.FromStatus != db.Created || event.ToStatus != db.Consented || event.Actor != "Patient" ||
+			event.ActorId != "user" || event.Details != "test" || event.Created == 0 {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	})
+	t.Run("Abort resets upload", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(&database)
+		database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+		database.UpdatePayloadKeyById(referralId, "key")
+		database.UpdateManifestById(referralId, "manifest", "signature")
+		testhelper.CreateMockFiles(&database, referralId, "", []db.FileObject{{Name: "a", Checksum: "1"}})
+		referral, _ := database.GetReferralById(referralId)
+		err := statemachine.Apply(&database, referral, statemachine.Trigger{Actor: statemachine.Origin}, db.Granted)
+		if err != nil {
+			t.Errorf("Apply error %s", err)
+			return
+		}
+		referral, _ = database.GetReferralById(referralId)
+		files, _ := database.GetFilesByReferral(referralId)
+		if referral.ReferralStatus != db.Granted || referral.PayloadKey != "" || referral.Manifest != "" || len(files) != 0 {
+			t.Errorf("Upload was not reset: %s %q %q %d files",
+				referral.ReferralStatus, referral.PayloadKey, referral.Manifest, len(files))
+		}
+	})
+	t.Run("Failed effect", func(t *testing.T) {
+		idx := slices.IndexFunc(statemachine.Transitions, func(tr statemachine.Transition) bool {
+			return tr.From == db.UploadIncomplete && tr.To == db.Granted
+		})
+		effects := statemachine.Transitions[idx].Effects
+		defer func() { statemachine.Transitions[idx].Effects = effects }()
+		statemachine.Transitions[idx].Effects = append(slices.Clone(effects), func(*db.Database, int) error {
+			return errors.New("effect failed")
+		})
+		referralId, _ := testhelper.CreateMockReferral(&database)
+		database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+		database.UpdatePayloadKeyById(referralId, "key")
+		testhelper.CreateMockFiles(&database, referralId, "", []db.FileObject{{Name: "a", Checksum: "1"}})
+		referral, _ := database.GetReferralById(referralId)
+		err := statemachine.Apply(&database, referral, statemachine.Trigger{Actor: statemachine.Origin}, db.Granted)
+		if err == nil || errors.Is(err, statemachine.ErrConflict) {
+			t.Errorf("Want effect error, Got %v", err)
+		}
+		referral, _ = database.GetReferralById(referralId)
+		files, _ := database.GetFilesByReferral(referralId)
+		events, _ := database.GetEventsByReferral(referralId)
+		if referral.ReferralStatus != db.UploadIncomplete || referral.PayloadKey != "key" || len(files) != 1 || len(events) != 0 {
+			t.Errorf("Transition was not rolled back: %s %q %d files %d events",
+				referral.ReferralStatus, referral.PayloadKey, len(files), len(events))
+		}
+	})
+	t.Run("Stale status", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(&database)
+		database.UpdateStatusReferralById(referralId, db.Consented)
+		referral, _ := database.GetReferralById(referralId)
+		// another request declines first
+		database.UpdateStatusReferralById(referralId, db.NotGranted)
+		err := statemachine.Apply(&database, referral, statemachine.Trigger{Actor: statemachine.Destination}, db.Granted)
+		if !errors.Is(err, statemachine.ErrConflict) {
+			t.Errorf("Want %s, Got %v", statemachine.ErrConflict, err)
+		}
+		referral, _ = database.GetReferralById(referralId)
+		if referral.ReferralStatus != db.NotGranted {
+			t.Errorf("Want %s, Got %s", db.NotGranted, referral.ReferralStatus)
+		}
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(&database)
+		database.UpdateStatusReferralById(referralId, db.Consented)
+		referral, _ := database.GetReferralById(referralId)
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(to db.ReferralStatus) {
+				defer wg.Done()
+				errs <- statemachine.Apply(&database, referral, statemachine.Trigger{Actor: statemachine.Destination}, to)
+			}([]db.ReferralStatus{db.Granted, db.NotGranted}[i%2])
+		}
+		wg.Wait()
+		close(errs)
+		applied := 0
+		for err := range errs {
+			if err == nil {
+				applied++
+			} else if !errors.Is(err, statemachine.ErrConflict) {
+				t.Errorf("Want %s, Got %s", statemachine.ErrConflict, err)
+			}
+		}
+		if applied != 1 {
+			t.Errorf("got %d applied transitions, want 1", applied)
+		}
+	})
+}
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: x", statemachine.ErrConflict), 409},
+		{fmt.Errorf("%w: x", statemachine.ErrIllegalTransition), 400},
+		{fmt.Errorf("%w: x", statemachine.ErrForbidden), 400},
+		{errors.New("could not update referral"), 500},
+	}
+	for _, tt := range tests {
+		if got := statemachine.HTTPStatus(tt.err); got != tt.want {
+			t.Errorf("%s: Want %d, Got %d", tt.err, tt.want, got)
+		}
+	}
+}
@@ -1,17 +1,25 @@
 package testing
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
+	"simplemts/lib"
 	db "simplemts/lib/database"
 	uploadhandler "simplemts/referralServer/uploadHandler"
 	"strings"
+	"time"
 )
 
 type Creation struct {
 	db.PatientObject
 	db.ReferralObject
+	Urgency db.Urgency `json:",omitempty"`
 }
 
 func GenerateMockCreation(c Creation) (output []byte) {
@@ -116,12 +124,54 @@ func CreateMockChunkBegin(
 	return
 }
 
+// Self-signed client certificate, it can be used as its own CA
+func CreateMockCertificate(commonName string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, privateKey, err
+}
+
+// Records a certificate for the hospital, creating the hospital if needed
+func CreateMockHospitalCertificate(database *db.Database, hospitalId string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	cert, privateKey, err := CreateMockCertificate(hospitalId)
+	if err != nil {
+		return nil, nil, err
+	}
+	hospital, ok := database.GetHospitalByHospitalId(hospitalId)
+	if !ok {
+		hospital.Id, _ = database.ServerCreateHospital(db.Hospital{
+			HospitalId:   hospitalId,
+			HospitalName: hospitalId,
+		})
+	}
+	database.UpdateHospitalCertificate(hospital.Id, lib.EncodeCertificatePEM(cert))
+	return cert, privateKey, nil
+}
+
 type MockRequester struct {
 	ResponseStatus    int
 	ResponseData      []byte
 	RequestURL        string
 	RequestBody       string
 	RequestBodyReader io.Reader
+	RequestOffset     int64
 }
 
 func (mr *MockRequester) MakeJsonRequestRaw(URL string, body string) (io.ReadCloser, int, error) {
@@ -136,6 +186,13 @@ func (mr *MockRequester) MakeGetRequestRaw(URL string) (io.ReadCloser, int, erro
 	return io.NopCloser(strings.NewReader(string(mr.ResponseData))), mr.ResponseStatus, nil
 }
 
+func (mr *MockRequester) MakeGetRangeRequestRaw(URL string, offset int64, ifRange string) (io.ReadCloser, int, error) {
+	mr.RequestURL = URL
+	mr.RequestBody = ""
+	mr.RequestOffset = offset
+	return io.NopCloser(strings.NewReader(string(mr.ResponseData))), mr.ResponseStatus, nil
+}
+
 func (mr *MockRequester) MakeJsonRequest(URL string, body string) (string, int, error) {
 	mr.RequestURL = URL
 	mr.RequestBody = body
@@ -0,0 +1,23 @@
+package lib
+
+import (
+	db "simplemts/lib/database"
+	"time"
+)
+
+// Time the destination has to answer a referral
+func ResponseWindow(urgency db.Urgency) time.Duration {
+	switch urgency {
+	case db.Emergency:
+		return time.Duration(GetEnvAsInt("DEADLINE_EMERGENCY_MIN", 60)) * time.Minute
+	case db.Urgent:
+		return time.Duration(GetEnvAsInt("DEADLINE_URGENT_MIN", 24*60)) * time.Minute
+	default:
+		return time.Duration(GetEnvAsInt("DEADLINE_ROUTINE_MIN", 7*24*60)) * time.Minute
+	}
+}
+
+// Unix time the destination has to answer by
+func ResponseDeadline(urgency db.Urgency, created time.Time) int64 {
+	return created.Add(ResponseWindow(urgency)).Unix()
+}
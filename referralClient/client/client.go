@@ -3,6 +3,7 @@ package client
 import (
 	"bytes"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -80,6 +81,28 @@ func (c *Client) MakeGetRequestRaw(URL string) (io.ReadCloser, int, error) {
 	return res.Body, res.StatusCode, nil
 }
 
+// Requests from offset to the end, If-Range makes the server send the whole file if it changed
+func (c *Client) MakeGetRangeRequestRaw(URL string, offset int64, ifRange string) (io.ReadCloser, int, error) {
+	// Create
+	req, err := http.NewRequest(http.MethodGet, URL, nil)
+	if err != nil {
+		return nil, 500, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+
+	// Making Request
+	res, err := c.service.Do(req)
+	if err != nil {
+		return nil, 500, err
+	}
+	return res.Body, res.StatusCode, nil
+}
+
 func (c *Client) MakeGetRequest(URL string) (string, int, error) {
 	bodyCloser, code, err := c.MakeGetRequestRaw(URL)
 	if err != nil {
@@ -45,6 +45,9 @@ type RouteHander struct {
 	Database  *db.Database
 	uploadDir string
 	resultDir string
+	caFile    string
+	keyFile   string
+	certFile  string
 	His       *hishandler.His
 }
 
@@ -60,6 +63,9 @@ func (frontend FrontendServer) RegisterRoutes(
 		Database:  database,
 		uploadDir: lib.GetEnv("ORIGIN_UPLOAD_DIR", "../../client-upload"),
 		resultDir: lib.GetEnv("DEST_RESULT_DIR", "../../client-upload"),
+		caFile:    path.Join(lib.GetEnv("AUTH_DIR", "./auth"), lib.GetEnv("CA_FILE", "./ca.crt")),
+		keyFile:   path.Join(lib.GetEnv("AUTH_DIR", "./auth"), lib.GetEnv("KEY_FILE", "./origin.key")),
+		certFile:  path.Join(lib.GetEnv("AUTH_DIR", "./auth"), lib.GetEnv("CERT_FILE", "./origin.crt")),
 		His:       his,
 	}
 	frontend.router.Use(lib.CORS)
@@ -74,10 +80,16 @@ func (frontend FrontendServer) RegisterRoutes(
 	frontend.router.HandleFunc("/referral/{referralId}", handler.GetReferral).Methods("GET")
 	// staff endpoints
 	frontend.router.HandleFunc("/staff", handler.ListStaffReferral).Methods("GET")
+	frontend.router.HandleFunc("/overdue", handler.GetOverdue).Methods("GET")
 	frontend.router.HandleFunc("/referral/{referralId}/grant", handler.GrantReferral).Methods("POST")
+	frontend.router.HandleFunc("/referral/{referralId}/cancel", handler.CancelReferral).Methods("POST")
+	frontend.router.HandleFunc("/referral/{referralId}/forward", handler.ForwardReferral).Methods("POST")
+	frontend.router.HandleFunc("/referral/{referralId}/counter", handler.CreateCounterReferral).Methods("POST")
+	frontend.router.HandleFunc("/referral/{referralId}/returned", handler.GetReturnedFiles).Methods("GET")
 	frontend.router.HandleFunc("/referral/{referralId}/file", handler.GetFiles).Methods("GET")
 	frontend.router.HandleFunc("/referral/{referralId}/outfile", handler.GetOutFiles).Methods("GET")
 	frontend.router.HandleFunc("/referral/{referralId}/download/{fileName}", handler.DownloadFile).Methods("GET")
+	frontend.router.HandleFunc("/referral/{referralId}/receipt", handler.GetReceipt).Methods("GET")
 	frontend.router.HandleFunc("/assign/{referralId}", handler.AssignDoctor).Methods("POST")
 	frontend.router.HandleFunc("/assign/{referralId}", handler.CheckAssign).Methods("GET")
 	frontend.router.HandleFunc("/assign/{referralId}/data", handler.GetOutRefFile).Methods("GET")
@@ -163,14 +175,25 @@ func (rh *RouteHander) CreateReferral(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	request.Origin = lib.GetEnv("HOSPITAL_ID", "1111") // Not trust frontend
+	// Broadcast to several destinations, the first one stands in as destination
+	candidates := form.Value["Candidates"]
+	if request.Destination == "" && len(candidates) > 0 {
+		request.Destination = candidates[0]
+	}
 
 	// Send data to server
 	serverRequest := struct {
 		db.ReferralObject
 		db.PatientObject
+		Candidates []string   `json:"Candidates,omitempty"`
+		Ranked     bool       `json:"Ranked"`
+		Urgency    db.Urgency `json:"Urgency"`
 	}{
 		ReferralObject: request.ReferralObject,
 		PatientObject:  request.PatientObject,
+		Candidates:     candidates,
+		Ranked:         getItem("Ranked", form) == "true",
+		Urgency:        db.Urgency(getItem("Urgency", form)),
 		// not send files
 	}
 	// Check files
@@ -250,6 +273,234 @@ func (rh *RouteHander) CreateReferral(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, resp)
 }
 
+// Payload key of a received referral, wrapped again for another destination
+func (rh *RouteHander) rewrapPayloadKey(referralId string, destination string) (payloadKey string, err error) {
+	resp, code, err := rh.Client.MakeGetRequestRaw(rh.ServerURL + "/" + referralId + "/download")
+	if err != nil {
+		return
+	}
+	if code != 200 {
+		return "", fmt.Errorf("could not get payload key: %d", code)
+	}
+	listing := struct {
+		PayloadKey string `json:"PayloadKey" validate:"required"`
+	}{}
+	err = lib.DecodeValidate(&listing, resp)
+	if err != nil {
+		return
+	}
+	cert, err := lib.LoadCert(rh.certFile, rh.keyFile)
+	if err != nil {
+		return
+	}
+	key, err := lib.UnwrapKey(cert.PrivateKey, listing.PayloadKey)
+	if err != nil {
+		return
+	}
+	destCert, err := lib.FetchHospitalCertificate(rh.Client, rh.ServerURL, rh.caFile, destination)
+	if err != nil {
+		return
+	}
+	return lib.WrapKey(destCert, key)
+}
+
+// Destination passes the referral on to another hospital
+func (rh *RouteHander) ForwardReferral(w http.ResponseWriter, r *http.Request) {
+	referralId := mux.Vars(r)["referralId"]
+	request := struct {
+		Destination string `json:"Destination" validate:"required"`
+		Reason      string `json:"Reason" validate:"required"`
+		PayloadKey  string `json:"PayloadKey"`
+	}{}
+	err := lib.DecodeValidate(&request, r.Body)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	resp, code, err := rh.Client.MakeGetRequestRaw(rh.ServerURL + "/" + referralId)
+	if err != nil || code != 200 {
+		lib.ErrorMessageHandler(w, r, 500, "Could not get referral")
+		return
+	}
+	referral := struct {
+		ReferralStatus db.ReferralStatus `json:"ReferralStatus" validate:"required"`
+	}{}
+	err = lib.DecodeValidate(&referral, resp)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, err.Error())
+		return
+	}
+	// Received payload goes on without a new upload from the origin
+	if referral.ReferralStatus == db.Complete {
+		request.PayloadKey, err = rh.rewrapPayloadKey(referralId, request.Destination)
+		if err != nil {
+			lib.ErrorMessageHandler(w, r, 500, fmt.Sprintf("Could not wrap payload key: %s", err))
+			return
+		}
+	}
+	forwardJson, err := json.Marshal(request)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	respForward, code, err := rh.Client.MakeJsonRequest(rh.ServerURL+"/"+referralId+"/forward", string(forwardJson))
+	if err != nil || code != 200 {
+		w.WriteHeader(code)
+		fmt.Fprint(w, respForward)
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprint(w, respForward)
+}
+
+// Destination sends results back, files are encrypted and uploaded by the polling handler
+func (rh *RouteHander) CreateCounterReferral(w http.ResponseWriter, r *http.Request) {
+	referralId := mux.Vars(r)["referralId"]
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "multipart/form-data") {
+		lib.ErrorMessageHandler(w, r, 400, "Not a form-data request")
+		return
+	}
+	err := r.ParseMultipartForm(32 << 20) // max 32mb
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	form := r.MultipartForm
+	if len(form.File["files"]) == 0 {
+		lib.ErrorMessageHandler(w, r, 400, "Could not send results: no files")
+		return
+	}
+	// check duplicate
+	dupes := map[string]bool{}
+	for _, file := range form.File["files"] {
+		if _, has := dupes[file.Filename]; has {
+			lib.ErrorMessageHandler(w, r, 400, fmt.Sprint("Could not upload duplicate filename ", file.Filename))
+			return
+		}
+		dupes[file.Filename] = true
+	}
+	// Files are staged first, the counter-referral can be uploaded as soon as it exists
+	if err = os.MkdirAll(rh.uploadDir, 0770); err != nil {
+		lib.ErrorMessageHandler(w, r, 500, err.Error())
+		return
+	}
+	stagingDir, err := os.MkdirTemp(rh.uploadDir, "counter-")
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, err.Error())
+		return
+	}
+	defer os.RemoveAll(stagingDir)
+	err = saveFormFiles(path.Join(stagingDir, "files"), form.File["files"])
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, fmt.Sprintf("Could not save files: %s", err))
+		return
+	}
+	jsonRequest, _ := json.Marshal(struct {
+		Reason string `json:"Reason"`
+	}{
+		Reason: getItem("Reason", form),
+	})
+	resp, code, err := rh.Client.MakeJsonRequest(rh.ServerURL+"/"+referralId+"/counter", string(jsonRequest))
+	if err != nil || code != 201 {
+		fmt.Println("Server-side Counter-referral Creation Error:", resp)
+		lib.ErrorMessageHandler(w, r, 500, fmt.Sprint("Could not create counter-referral: ", code))
+		return
+	}
+	response := struct {
+		Id int `json:"id"`
+	}{}
+	err = json.NewDecoder(strings.NewReader(resp)).Decode(&response)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, "Could not decode server response")
+		return
+	}
+	// Files appear all at once, polling never encrypts a partial set
+	err = os.Rename(stagingDir, path.Join(rh.uploadDir, fmt.Sprint(response.Id)))
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, fmt.Sprintf("Could not move files: %s", err))
+		return
+	}
+	w.WriteHeader(201)
+	fmt.Fprint(w, resp)
+}
+
+func saveFormFiles(dir string, files []*multipart.FileHeader) error {
+	for _, file := range files {
+		if err := saveFormFile(path.Join(dir, file.Filename), file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveFormFile(filePath string, file *multipart.FileHeader) error {
+	uploadedFile, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer uploadedFile.Close()
+	f, err := lib.CreateFile(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, uploadedFile); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Documents sent back for an outgoing referral, files are listed once a counter-referral is downloaded
+func (rh *RouteHander) GetReturnedFiles(w http.ResponseWriter, r *http.Request) {
+	referralId := mux.Vars(r)["referralId"]
+	resp, code, err := rh.Client.MakeGetRequestRaw(rh.ServerURL + "/" + referralId + "/counter")
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, err.Error())
+		return
+	}
+	if code != 200 {
+		lib.ErrorMessageHandler(w, r, code, "Could not get counter-referrals")
+		return
+	}
+	type returned struct {
+		Id             int               `json:"Id" validate:"required"`
+		ReferralStatus db.ReferralStatus `json:"ReferralStatus" validate:"required"`
+		Reason         string            `json:"Reason"`
+		Created        int64             `json:"Created"`
+		Files          []string          `json:"Files"`
+	}
+	response := struct {
+		Referrals []returned `json:"referrals" validate:"required,dive"`
+	}{}
+	err = lib.DecodeValidate(&response, resp)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, err.Error())
+		return
+	}
+	for i, counter := range response.Referrals {
+		response.Referrals[i].Files = []string{}
+		if counter.ReferralStatus != db.CounterComplete {
+			continue
+		}
+		files, err := os.ReadDir(path.Join(rh.resultDir, fmt.Sprintf("referral-%d", counter.Id)))
+		if err != nil {
+			lib.ErrorMessageHandler(w, r, 500, err.Error())
+			return
+		}
+		for _, file := range files {
+			response.Referrals[i].Files = append(response.Referrals[i].Files, file.Name())
+		}
+	}
+	jsonPayload, err := json.Marshal(response)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, err.Error())
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprint(w, string(jsonPayload))
+}
+
 func (rh *RouteHander) CheckAssign(w http.ResponseWriter, r *http.Request) {
 	referralId, err := lib.GetReferralId(r)
 	if err != nil {
@@ -377,11 +628,25 @@ func (rh *RouteHander) GetHospitals(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, resp)
 }
 
+// Referrals of this hospital stuck past their SLA
+func (rh *RouteHander) GetOverdue(w http.ResponseWriter, r *http.Request) {
+	resp, code, err := rh.Client.MakeGetRequest(rh.ServerURL + "/overdue")
+	if err != nil || code != 200 {
+		fmt.Println(resp)
+		lib.ErrorMessageHandler(w, r, 500, "Could not get overdue referrals")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprint(w, resp)
+}
+
 func (rh *RouteHander) GrantReferral(w http.ResponseWriter, r *http.Request) {
 	// todo check if staff
 	referralId := mux.Vars(r)["referralId"]
 	response := struct {
-		Granted bool `json:"Granted"`
+		Granted       bool           `json:"Granted"`
+		DeclineCode   db.DeclineCode `json:"DeclineCode"`
+		DeclineReason string         `json:"DeclineReason"`
 	}{}
 	err := lib.DecodeValidate(&response, r.Body)
 	if err != nil {
@@ -402,6 +667,33 @@ func (rh *RouteHander) GrantReferral(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 	fmt.Fprint(w, resp)
 }
+
+// Origin withdraws a referral, the server purges anything uploaded
+func (rh *RouteHander) CancelReferral(w http.ResponseWriter, r *http.Request) {
+	referralId := mux.Vars(r)["referralId"]
+	response := struct {
+		Reason string `json:"Reason" validate:"required"`
+	}{}
+	err := lib.DecodeValidate(&response, r.Body)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	cancelJson, err := json.Marshal(response)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	resp, code, err := rh.Client.MakeJsonRequest(rh.ServerURL+"/"+referralId+"/cancel", (string)(cancelJson))
+	if err != nil || code != 200 {
+		w.WriteHeader(code)
+		fmt.Fprint(w, resp)
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprint(w, resp)
+}
+
 func (rh *RouteHander) GetFiles(w http.ResponseWriter, r *http.Request) {
 	referralId := mux.Vars(r)["referralId"]
 	files, err := os.ReadDir(path.Join(rh.resultDir, "referral-"+referralId))
@@ -456,6 +748,54 @@ func (rh *RouteHander) GetOutRefFile(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Delivery receipt from the server, verified with the destination's certificate from the key directory
+func (rh *RouteHander) GetReceipt(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	resp, code, err := rh.Client.MakeGetRequest(fmt.Sprintf("%s/%d/receipt", rh.ServerURL, referralId))
+	if err != nil || code != 200 {
+		fmt.Println(resp)
+		lib.ErrorMessageHandler(w, r, 500, "Could not get receipt")
+		return
+	}
+	stored := struct {
+		Destination      string `json:"Destination" validate:"required"`
+		Receipt          string `json:"Receipt" validate:"required"`
+		ReceiptSignature string `json:"ReceiptSignature" validate:"required"`
+	}{}
+	err = lib.DecodeValidate(&stored, io.NopCloser(strings.NewReader(resp)))
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, err.Error())
+		return
+	}
+	response := struct {
+		Receipt          lib.Receipt
+		ReceiptSignature string
+		Verified         bool
+	}{
+		ReceiptSignature: stored.ReceiptSignature,
+	}
+	cert, err := lib.FetchHospitalCertificate(rh.Client, rh.ServerURL, rh.caFile, stored.Destination)
+	if err != nil {
+		fmt.Println("Could not get destination certificate: ", err)
+	} else {
+		// the certificate is issued to the destination, checked when fetched
+		response.Receipt, err = lib.VerifyReceipt(cert, stored.Receipt, stored.ReceiptSignature)
+		response.Verified = err == nil &&
+			response.Receipt.ReferralId == referralId && response.Receipt.Destination == stored.Destination
+	}
+	receiptJson, err := json.Marshal(response)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, "Could not create payload")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprint(w, string(receiptJson))
+}
+
 func (rh *RouteHander) GetPatientDataSummary(w http.ResponseWriter, r *http.Request) {
 	patientId := mux.Vars(r)["patientId"]
 	sum, err := rh.His.GetPatientDataSummary(patientId)
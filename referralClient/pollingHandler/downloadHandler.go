@@ -1,11 +1,14 @@
 package pollinghandler
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path"
 	"simplemts/lib"
 	db "simplemts/lib/database"
+	"sync"
 )
 
 type ChunkFile = db.ChunkFile
@@ -17,21 +20,29 @@ const (
 	Complete   = db.CompleteChunk
 )
 
+const downloadAttempts = 2
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
 type FileTracking = struct {
 	UploadStatus db.UploadStatus `json:"UploadStatus"`
 	Name         string          `json:"Name"`
 	Checksum     string          `json:"Checksum"`
 }
 
-func (ph *PollingHandler) DownloadList(referralId int) ([]FileTracking, string, error) {
+type DownloadListing = struct {
+	PayloadKey        string         `json:"PayloadKey"`
+	Manifest          string         `json:"Manifest"`
+	ManifestSignature string         `json:"ManifestSignature"`
+	Files             []FileTracking `json:"Files"`
+}
+
+func (ph *PollingHandler) DownloadList(referralId int) (DownloadListing, error) {
 	// Check file list
-	response := struct {
-		PayloadKey string         `json:"PayloadKey"`
-		Files      []FileTracking `json:"Files"`
-	}{}
+	response := DownloadListing{}
 	err := ph.requestDecode(fmt.Sprintf("/%d/download", referralId), 200, &response)
 	if err != nil {
-		return []FileTracking{}, "", err
+		return DownloadListing{}, err
 	}
 	// Create tracking files
 	parentPath := path.Join(ph.destPayloadDir, fmt.Sprint(referralId)) // file exists in /download/referralId/fileId
@@ -48,29 +59,169 @@ func (ph *PollingHandler) DownloadList(referralId int) ([]FileTracking, string,
 		if file.UploadStatus == db.IncompleteUpload {
 			continue
 		}
+		// Skip already tracked
+		if _, exists := ph.Database.GetFileByReferralName(referralId, file.Name); exists {
+			continue
+		}
+		f.DownloadStatus = db.IncompleteDownload
 		_, ok := ph.Database.ClientCreateFile(f)
 		if !ok {
-			return response.Files, "", fmt.Errorf("could not create file for referral '%d'", referralId)
+			return response, fmt.Errorf("could not create file for referral '%d'", referralId)
 		}
 	}
-	return response.Files, response.PayloadKey, nil
+	return response, nil
 }
 
-func (ph *PollingHandler) DownloadFile(downloadPath string, referralId int, filename string) error {
-	filereader, statusCode, err := ph.client.MakeGetRequestRaw(ph.serverURL + fmt.Sprintf("/%d/download/%s", referralId, filename))
+// Downloads into filename.part, resuming from its size, then renames it to filename.
+// A part matching the checksum is renamed without a request
+func (ph *PollingHandler) DownloadFile(downloadPath string, referralId int, filename string, checksum string) error {
+	filePath := path.Join(downloadPath, filename)
+	partPath := filePath + ".part"
+	var offset int64
+	if stat, err := os.Stat(partPath); err == nil {
+		offset = stat.Size()
+	}
+	// stopped before the rename, the part is already the whole file
+	if offset > 0 {
+		if sum, err := checksumFile(partPath); err == nil && sum == checksum {
+			return os.Rename(partPath, filePath)
+		}
+	}
+	filereader, statusCode, err := ph.client.MakeGetRangeRequestRaw(
+		ph.serverURL+fmt.Sprintf("/%d/download/%s", referralId, filename),
+		offset, fmt.Sprintf(`"%s"`, checksum))
 	if err != nil {
 		return err
 	}
-	if statusCode != 200 {
-		return fmt.Errorf("request failed %s", err)
+	defer filereader.Close()
+	var f *os.File
+	switch statusCode {
+	case 206:
+		f, err = os.OpenFile(partPath, os.O_APPEND|os.O_WRONLY, 0660)
+	case 200:
+		// whole file, server does not have the same file or no range was asked
+		f, err = lib.CreateFile(partPath)
+	case 416:
+		// part is not a prefix of the file, start over
+		os.Remove(partPath)
+		return fmt.Errorf("could not resume '%s', download restarted", filename)
+	default:
+		return fmt.Errorf("request failed %d", statusCode)
 	}
-	f, err := lib.CreateFile(path.Join(downloadPath, filename))
 	if err != nil {
 		return err
 	}
 	_, err = io.Copy(f, filereader)
 	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
 		return err
 	}
+	return os.Rename(partPath, filePath)
+}
+
+// Downloads a file unless it is already there and compares it with the server checksum,
+// a mismatching file is removed and downloaded again
+func (ph *PollingHandler) DownloadVerified(downloadPath string, referralId int, file FileTracking) (err error) {
+	filePath := path.Join(downloadPath, file.Name)
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		if _, err = os.Stat(filePath); err != nil {
+			err = ph.DownloadFile(downloadPath, referralId, file.Name, file.Checksum)
+			if err != nil {
+				// partial file is kept to resume
+				return err
+			}
+		}
+		sum, err := checksumFile(filePath)
+		if err != nil {
+			return err
+		}
+		if sum == file.Checksum {
+			return nil
+		}
+		os.Remove(filePath)
+	}
+	return fmt.Errorf("file '%s': %w", file.Name, ErrChecksumMismatch)
+}
+
+// Downloads, verifies and decrypts every file, file rows keep the result for each file.
+// Nothing is downloaded unless the origin's manifest is valid
+func (ph *PollingHandler) ReceivePayload(referralId int, origin string) (err error) {
+	listing, err := ph.DownloadList(referralId)
+	if err != nil {
+		return fmt.Errorf("could not begin download: %s", err)
+	}
+	if err = ph.VerifyManifest(referralId, origin, listing); err != nil {
+		return err
+	}
+	fileList, payloadKey := listing.Files, listing.PayloadKey
+	files, ok := ph.Database.GetFilesByReferral(referralId)
+	if !ok {
+		return fmt.Errorf("could not get files for referral '%d'", referralId)
+	}
+	fileMap := db.FilestoMap(files)
+	for _, file := range fileList {
+		if file.UploadStatus != db.CompleteUpload {
+			return fmt.Errorf("file '%s' is not uploaded", file.Name)
+		}
+	}
+	downloadPath := path.Join(ph.destPayloadDir, fmt.Sprintf("referral-%d", referralId))
+	// Download
+	var wg sync.WaitGroup
+	for _, file := range fileList {
+		dbFile := fileMap[file.Name]
+		if dbFile.DownloadStatus == db.VerifiedDownload || dbFile.DownloadStatus == db.CompleteDownload {
+			continue
+		}
+		wg.Add(1)
+		go func(file FileTracking, fileId int) {
+			defer wg.Done()
+			err := ph.DownloadVerified(downloadPath, referralId, file)
+			if errors.Is(err, ErrChecksumMismatch) {
+				fmt.Println("Download error: ", err)
+				ph.Database.UpdateDownloadStatusFileById(fileId, db.ChecksumMismatch)
+				return
+			}
+			if err != nil {
+				fmt.Println("Download error: ", err)
+				ph.Database.UpdateDownloadStatusFileById(fileId, db.IncompleteDownload)
+				return
+			}
+			ph.Database.UpdateDownloadStatusFileById(fileId, db.VerifiedDownload)
+		}(file, dbFile.Id)
+	}
+	wg.Wait()
+	// Decrypt, only when every file is verified
+	files, _ = ph.Database.GetFilesByReferral(referralId)
+	fileMap = db.FilestoMap(files)
+	for _, file := range fileList {
+		status := fileMap[file.Name].DownloadStatus
+		if status != db.VerifiedDownload && status != db.CompleteDownload {
+			return fmt.Errorf("file '%s' is not verified: %s", file.Name, status)
+		}
+	}
+	decryptDir := path.Join(ph.resultDir, fmt.Sprintf("referral-%d", referralId))
+	privateKey, err := ph.privateKey()
+	if err != nil {
+		return fmt.Errorf("could not load private key: %s", err)
+	}
+	decryptKey, err := lib.UnwrapKey(privateKey, payloadKey)
+	if err != nil {
+		return fmt.Errorf("could not unwrap payload key: %s", err)
+	}
+	for _, file := range fileList {
+		dbFile := fileMap[file.Name]
+		if dbFile.DownloadStatus == db.CompleteDownload {
+			continue
+		}
+		err := FileDecrypt(path.Join(downloadPath, file.Name), path.Join(decryptDir, file.Name), decryptKey)
+		if err != nil {
+			ph.Database.UpdateDownloadStatusFileById(dbFile.Id, db.DecryptFailed)
+			return fmt.Errorf("decryption error for '%s': %s", file.Name, err)
+		}
+		ph.Database.UpdateDownloadStatusFileById(dbFile.Id, db.CompleteDownload)
+	}
 	return nil
 }
@@ -3,8 +3,8 @@ package pollinghandler
 import (
 	"fmt"
 	db "simplemts/lib/database"
-
-	"github.com/go-mail/mail"
+	"strings"
+	"time"
 )
 
 func (ph *PollingHandler) clearEmailSub(isIncoming bool) (err error) {
@@ -16,6 +16,8 @@ func (ph *PollingHandler) clearEmailSub(isIncoming bool) (err error) {
 		Destination string `json:"Destination" validate:"required"`
 		Reason      string `json:"Reason" validate:"required"`
 		Created     int64  `json:"Created" validate:"required"`
+		// Set for a broadcast referral
+		CandidateStatus db.CandidateStatus `json:"CandidateStatus"`
 	}
 	response := struct {
 		Referrals []referral `json:"referrals" validate:"required,dive"`
@@ -39,6 +41,15 @@ func (ph *PollingHandler) clearEmailSub(isIncoming bool) (err error) {
 		if ref.ReferralStatus == db.NotGranted {
 			ph.docNotGrantEmail[ref.Id] = true
 		}
+		if ref.ReferralStatus == db.Cancelled {
+			ph.staffCancelEmail[ref.Id] = true
+		}
+		if ref.ReferralStatus == db.Expired {
+			ph.docExpiredEmail[ref.Id] = true
+		}
+		if ref.CandidateStatus == db.CandidateUnavailable {
+			ph.staffClaimedEmail[ref.Id] = true
+		}
 	}
 	return nil
 }
@@ -57,70 +68,109 @@ func (ph *PollingHandler) clearEmail() (err error) {
 	return nil
 }
 
-func emailDocComplete(doctorName string, patientName string, referralId int, date string, hospitalName string) {
-	m := mail.NewMessage()
-	m.SetHeader("From", "email@redacted")
-	m.SetHeader("To", "email2@redacted")
-	m.SetHeader("Subject", fmt.Sprintf("[Patient Referral System] Referral Complete (ID:%d)", referralId))
-	m.SetBody("text/plain", fmt.Sprintf(
-		"Referral ID:%d\n\nDear %s,\nThis is an update on %s's referral on %s to %s.\n\nThe referral process is complete, please check details in the referral system",
-		referralId, doctorName, patientName, date, hospitalName))
-	d := mail.NewDialer("smtp.gmail.com", 587, "email@redacted", "csiu giwt cxwj eflo")
-	if err := d.DialAndSend(m); err != nil {
-
-		panic(err)
+func (ph *PollingHandler) emailDocComplete(doctorName string, patientName string, referralId int, date string, hospitalName string) error {
+	return ph.notify(ph.doctorEmail,
+		fmt.Sprintf("[Patient Referral System] Referral Complete (ID:%d)", referralId),
+		fmt.Sprintf(
+			"Referral ID:%d\n\nDear %s,\nThis is an update on %s's referral on %s to %s.\n\nThe referral process is complete, please check details in the referral system",
+			referralId, doctorName, patientName, date, hospitalName))
+}
 
+func declineText(code db.DeclineCode) string {
+	switch code {
+	case db.NoCapacity:
+		return "no capacity"
+	case db.WrongDepartment:
+		return "wrong department"
+	case db.NeedsInformation:
+		return "more information needed"
+	default:
+		return "other"
 	}
-	fmt.Println("Email Successfully Sent")
 }
 
-func emailDocNotGrant(doctorName string, patientName string, referralId int, date string, hospitalName string) {
-	m := mail.NewMessage()
-	m.SetHeader("From", "email@redacted")
-	m.SetHeader("To", "email2@redacted")
-	m.SetHeader("Subject", fmt.Sprintf("[Patient Referral System] Referral Permission Denied (ID:%d)", referralId))
-	m.SetBody("text/plain", fmt.Sprintf(
-		"Referral ID:%d\n\nDear %s,\nThis is an update on %s's referral on %s to %s.\n\n %s has denied the request to refer the patient, please check details in the referral system",
-		referralId, doctorName, patientName, date, hospitalName, hospitalName))
-	d := mail.NewDialer("smtp.gmail.com", 587, "email@redacted", "csiu giwt cxwj eflo")
-	if err := d.DialAndSend(m); err != nil {
-
-		panic(err)
+func (ph *PollingHandler) emailDocNotGrant(doctorName string, patientName string, referralId int, date string, hospitalName string,
+	declineCode db.DeclineCode, declineReason string) error {
+	return ph.notify(ph.doctorEmail,
+		fmt.Sprintf("[Patient Referral System] Referral Permission Denied (ID:%d)", referralId),
+		fmt.Sprintf(
+			"Referral ID:%d\n\nDear %s,\nThis is an update on %s's referral on %s to %s.\n\n %s has denied the request to refer the patient, please check details in the referral system\n\nReason: %s\n%s",
+			referralId, doctorName, patientName, date, hospitalName, hospitalName, declineText(declineCode), declineReason))
+}
 
-	}
-	fmt.Println("Email Successfully Sent")
+func (ph *PollingHandler) emailDocExpired(doctorName string, patientName string, referralId int, date string, hospitalName string) error {
+	return ph.notify(ph.doctorEmail,
+		fmt.Sprintf("[Patient Referral System] Referral Expired (ID:%d)", referralId),
+		fmt.Sprintf(
+			"Referral ID:%d\n\nDear %s,\nThis is an update on %s's referral on %s to %s.\n\nThe referral was not acted on in time and has expired, please check details in the referral system",
+			referralId, doctorName, patientName, date, hospitalName))
 }
 
-func emailStaffComplete(referralId int, date string, destinationHospital string, originHospital string) {
-	m := mail.NewMessage()
-	m.SetHeader("From", "email@redacted")
-	m.SetHeader("To", "email2@redacted")
-	m.SetHeader("Subject", fmt.Sprintf("[Patient Referral System] Referral from %s Complete (ID:%d)", originHospital, referralId))
-	m.SetBody("text/plain", fmt.Sprintf(
-		"Referral ID:%d\n\nDear %s staff,\nThis is an update on a referral from %s to your hospital, made on %s.\n\nThe referral process is complete, please check details in the referral system.",
-		referralId, destinationHospital, originHospital, date))
-	d := mail.NewDialer("smtp.gmail.com", 587, "email@redacted", "csiu giwt cxwj eflo")
-	if err := d.DialAndSend(m); err != nil {
+func (ph *PollingHandler) emailStaffComplete(referralId int, date string, destinationHospital string, originHospital string) error {
+	return ph.notify(ph.staffEmail,
+		fmt.Sprintf("[Patient Referral System] Referral from %s Complete (ID:%d)", originHospital, referralId),
+		fmt.Sprintf(
+			"Referral ID:%d\n\nDear %s staff,\nThis is an update on a referral from %s to your hospital, made on %s.\n\nThe referral process is complete, please check details in the referral system.",
+			referralId, destinationHospital, originHospital, date))
+}
 
-		panic(err)
+func (ph *PollingHandler) emailStaffGrant(referralId int, date string, destinationHospital string, originHospital string) error {
+	return ph.notify(ph.staffEmail,
+		fmt.Sprintf("[Patient Referral System] Requesting to Refer patient from %s (ID:%d)", originHospital, referralId),
+		fmt.Sprintf(
+			"Referral ID:%d\n\nDear %s staff,\nThis is a request to referral a patient from %s to your hospital, made on %s.\n\nPlease check request details in the referral system.",
+			referralId, destinationHospital, originHospital, date))
+}
 
-	}
-	fmt.Println("Email Successfully Sent")
+func (ph *PollingHandler) emailStaffCancel(referralId int, date string, destinationHospital string, originHospital string) error {
+	return ph.notify(ph.staffEmail,
+		fmt.Sprintf("[Patient Referral System] Referral from %s Cancelled (ID:%d)", originHospital, referralId),
+		fmt.Sprintf(
+			"Referral ID:%d\n\nDear %s staff,\nThis is an update on a referral from %s to your hospital, made on %s.\n\n%s has cancelled the referral, please check details in the referral system.",
+			referralId, destinationHospital, originHospital, date, originHospital))
 }
 
-func emailStaffGrant(referralId int, date string, destinationHospital string, originHospital string) {
-	m := mail.NewMessage()
-	m.SetHeader("From", "email@redacted")
-	m.SetHeader("To", "email2@redacted")
-	m.SetHeader("Subject", fmt.Sprintf("[Patient Referral System] Requesting to Refer patient from %s (ID:%d)", originHospital, referralId))
-	m.SetBody("text/plain", fmt.Sprintf(
-		"Referral ID:%d\n\nDear %s staff,\nThis is a request to referral a patient from %s to your hospital, made on %s.\n\nPlease check request details in the referral system.",
-		referralId, destinationHospital, originHospital, date))
-	d := mail.NewDialer("smtp.gmail.com", 587, "email@redacted", "csiu giwt cxwj eflo")
-	if err := d.DialAndSend(m); err != nil {
+// Destination of the referral is the claiming hospital, staff are not greeted by name
+func (ph *PollingHandler) emailStaffUnavailable(referralId int, date string, originHospital string) error {
+	return ph.notify(ph.staffEmail,
+		fmt.Sprintf("[Patient Referral System] Referral from %s No Longer Available (ID:%d)", originHospital, referralId),
+		fmt.Sprintf(
+			"Referral ID:%d\n\nDear staff,\nThis is an update on a referral from %s sent to several hospitals, made on %s.\n\nAnother hospital has accepted the patient, the referral is no longer available.",
+			referralId, originHospital, date))
+}
 
-		panic(err)
+func (ph *PollingHandler) emailStaffEscalate(referralId int, date string, destinationHospital string, originHospital string,
+	urgency db.Urgency, deadline time.Time) error {
+	status := fmt.Sprintf("Please respond by %s.", deadline.Format("2006-01-02 15:04"))
+	if time.Now().After(deadline) {
+		status = fmt.Sprintf("The response deadline (%s) has passed, please respond as soon as possible.", deadline.Format("2006-01-02 15:04"))
+	}
+	return ph.notify(ph.staffEmail,
+		fmt.Sprintf("[Patient Referral System] %s Referral from %s Waiting (ID:%d)", strings.ToUpper(string(urgency)), originHospital, referralId),
+		fmt.Sprintf(
+			"Referral ID:%d\n\nDear %s staff,\nThe %s referral from %s to your hospital, made on %s, is still waiting for your response.\n\n%s",
+			referralId, destinationHospital, urgency, originHospital, date, status))
+}
 
+// Send failures are returned so the referral stays pending and is sent again
+func (ph *PollingHandler) notify(to []string, subject string, body string) error {
+	err := ph.Notifier.Notify(Message{To: to, Subject: subject, Body: body})
+	if err != nil {
+		return fmt.Errorf("could not send email: %s", err)
 	}
 	fmt.Println("Email Successfully Sent")
+	return nil
+}
+
+// Sends a referral's notification unless email is off or it was sent before,
+// a failed send is not recorded so the next attempt sends it again
+func (ph *PollingHandler) notifyOnce(sent map[int]bool, referralId int, send func() error) error {
+	if ph.disableEmail || sent[referralId] {
+		return nil
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	sent[referralId] = true
+	return nil
 }
@@ -0,0 +1,201 @@
+package pollinghandler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"simplemts/lib"
+)
+
+// Payload format (version 2)
+//
+//	header:  "SMTS" | version (1 byte) | segment size (uint32) | nonce prefix (7 bytes)
+//	segment: AES-GCM(plaintext segment), last segment can be shorter or empty
+//
+// Segment nonce is prefix | counter (uint32) | last flag (1 byte), so segments
+// cannot be reordered, dropped or truncated. The header is authenticated as
+// additional data. Files without the header are version 1: nonce | AES-GCM(whole file)
+const (
+	streamMagic       = "SMTS"
+	streamVersion     = 2
+	streamPrefixSize  = 7
+	streamHeaderSize  = len(streamMagic) + 1 + 4 + streamPrefixSize
+	StreamSegmentSize = 64 * 1024
+	maxSegmentSize    = 16 * 1024 * 1024
+)
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, streamPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func newGCM(secretKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Reads up to len(buf) bytes, last is true when nothing is left after them
+func readSegment(r *bufio.Reader, buf []byte) (n int, last bool, err error) {
+	n, err = io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+	if _, err = r.Peek(1); err == io.EOF {
+		return n, true, nil
+	}
+	return n, false, err
+}
+
+func FileEncrypt(filePath string, outpath string, secretKey []byte) (err error) {
+	gcm, err := newGCM(secretKey)
+	if err != nil {
+		return
+	}
+	in, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := lib.CreateFile(outpath)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	// header
+	prefix := make([]byte, streamPrefixSize)
+	if _, err = io.ReadFull(rand.Reader, prefix); err != nil {
+		return
+	}
+	header := []byte(streamMagic)
+	header = append(header, streamVersion)
+	header = binary.BigEndian.AppendUint32(header, StreamSegmentSize)
+	header = append(header, prefix...)
+	if _, err = out.Write(header); err != nil {
+		return
+	}
+	// segments
+	r := bufio.NewReaderSize(in, StreamSegmentSize)
+	buf := make([]byte, StreamSegmentSize)
+	sealed := make([]byte, 0, StreamSegmentSize+gcm.Overhead())
+	for counter := uint32(0); ; counter++ {
+		n, last, err := readSegment(r, buf)
+		if err != nil {
+			return err
+		}
+		sealed = gcm.Seal(sealed[:0], segmentNonce(prefix, counter, last), buf[:n], header)
+		if _, err = out.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return fmt.Errorf("file is too large to encrypt")
+		}
+	}
+}
+
+func FileDecrypt(inpath string, outPath string, secretKey []byte) (err error) {
+	gcm, err := newGCM(secretKey)
+	if err != nil {
+		return
+	}
+	in, err := os.Open(inpath)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	r := bufio.NewReaderSize(in, StreamSegmentSize)
+	out, err := lib.CreateFile(outPath)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		// no partial plaintext
+		if err != nil {
+			os.Remove(outPath)
+		}
+	}()
+	magic, err := r.Peek(len(streamMagic) + 1)
+	if err == nil && bytes.Equal(magic, append([]byte(streamMagic), streamVersion)) {
+		return decryptStream(gcm, r, out)
+	}
+	return decryptSingle(gcm, r, out)
+}
+
+func decryptStream(gcm cipher.AEAD, r *bufio.Reader, out io.Writer) (err error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("could not read header: %s", err)
+	}
+	segmentSize := binary.BigEndian.Uint32(header[len(streamMagic)+1:])
+	if segmentSize == 0 || segmentSize > maxSegmentSize {
+		return fmt.Errorf("invalid segment size %d", segmentSize)
+	}
+	prefix := header[streamHeaderSize-streamPrefixSize:]
+	segment := make([]byte, int(segmentSize)+gcm.Overhead())
+	plain := make([]byte, 0, segmentSize)
+	for counter := uint32(0); ; counter++ {
+		n, last, err := readSegment(r, segment)
+		if err != nil {
+			return err
+		}
+		plain, err = gcm.Open(plain[:0], segmentNonce(prefix, counter, last), segment[:n], header)
+		if err != nil {
+			return fmt.Errorf("segment %d: %s", counter, err)
+		}
+		if _, err = out.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return fmt.Errorf("too many segments")
+		}
+	}
+}
+
+// Version 1 payloads are sealed in a single message
+func decryptSingle(gcm cipher.AEAD, r io.Reader, out io.Writer) (err error) {
+	cipherText, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+	nonceSize := gcm.NonceSize()
+	if len(cipherText) < nonceSize {
+		return fmt.Errorf("payload is too short")
+	}
+	nonce, ciphertext := cipherText[:nonceSize], cipherText[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return
+	}
+	_, err = out.Write(plaintext)
+	return
+}
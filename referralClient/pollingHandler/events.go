@@ -0,0 +1,112 @@
+package pollinghandler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"simplemts/lib"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ErrStreamTimeout = errors.New("no event or keepalive in time")
+
+// Referral change pushed by the server
+type StreamEvent struct {
+	Direction string // incoming or outgoing
+	Data      PollData
+}
+
+// Keeps the /events stream open, up tells Run whether it is
+func (ph *PollingHandler) stream(events chan<- StreamEvent, up chan<- bool) {
+	retry := time.Duration(lib.GetEnvAsInt("EVENTS_RETRY_S", 5)) * time.Second
+	for {
+		err := ph.Listen(events, up)
+		fmt.Println("Event stream dropped, polling instead:", err)
+		up <- false
+		time.Sleep(retry)
+	}
+}
+
+// Reads the /events stream from the stored cursors until it ends or goes quiet
+// for two keepalive intervals, a half-open connection would otherwise look live
+func (ph *PollingHandler) Listen(events chan<- StreamEvent, up chan<- bool) (err error) {
+	since := min(ph.Database.GetPollCursor("incoming"), ph.Database.GetPollCursor("outgoing"))
+	body, code, err := ph.client.MakeGetRequestRaw(fmt.Sprintf("%s/events?since=%d", ph.serverURL, since))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if code != 200 {
+		return fmt.Errorf("could not open event stream: %d", code)
+	}
+	up <- true
+	timeout := 2 * time.Duration(lib.GetEnvAsInt("EVENTS_KEEPALIVE_S", 15)) * time.Second
+	var expired atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		expired.Store(true)
+		body.Close()
+	})
+	defer timer.Stop()
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	// id, retry and comments are not used, the referral carries its Seq
+	event, data := "", ""
+	for scanner.Scan() {
+		timer.Reset(timeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data != "" && (event == "incoming" || event == "outgoing") {
+				pollData := PollData{}
+				if err := json.Unmarshal([]byte(data), &pollData); err != nil {
+					return fmt.Errorf("could not decode event: %s", err)
+				}
+				// handling can take longer than the stream may stay quiet
+				timer.Stop()
+				events <- StreamEvent{Direction: event, Data: pollData}
+				timer.Reset(timeout)
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if expired.Load() {
+		return ErrStreamTimeout
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// Handles a pushed change unless polling already got past it
+func (ph *PollingHandler) HandleEvent(event StreamEvent) {
+	if event.Data.Seq <= ph.Database.GetPollCursor(event.Direction) {
+		return
+	}
+	ph.handleChange(event.Direction, event.Data)
+	if !ph.Database.SetPollCursor(event.Direction, event.Data.Seq) {
+		fmt.Println("Could not store cursor:", event.Direction)
+	}
+}
+
+// Retries pending work without asking the server for changes
+func (ph *PollingHandler) HandlePending() {
+	if !ph.resumed {
+		err := ph.resume()
+		if err != nil {
+			fmt.Println("Could not resume pending referrals:", err)
+			return
+		}
+	}
+	for direction := range ph.pending {
+		ph.handlePending(direction, nil)
+	}
+}
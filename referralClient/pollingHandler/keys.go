@@ -0,0 +1,92 @@
+package pollinghandler
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"simplemts/lib"
+	db "simplemts/lib/database"
+	"time"
+)
+
+var ErrManifestInvalid = errors.New("manifest is invalid")
+
+func (ph *PollingHandler) HospitalCertificate(hospitalId string) (*x509.Certificate, error) {
+	return lib.FetchHospitalCertificate(ph.client, ph.serverURL, ph.caFile, hospitalId)
+}
+
+func (ph *PollingHandler) privateKey() (crypto.PrivateKey, error) {
+	cert, err := lib.LoadCert(ph.certFile, ph.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return cert.PrivateKey, nil
+}
+
+func (ph *PollingHandler) signManifest(referralId int, origin string, files []db.FileObject) (manifest string, signature string, err error) {
+	privateKey, err := ph.privateKey()
+	if err != nil {
+		return
+	}
+	m := lib.Manifest{
+		ReferralId: referralId,
+		Origin:     origin,
+	}
+	for _, file := range files {
+		m.Files = append(m.Files, lib.ManifestFile{Name: file.Name, Checksum: file.Checksum})
+	}
+	return lib.SignManifest(privateKey, m)
+}
+
+// Checks the listing was signed by the origin and describes exactly the files to download
+func (ph *PollingHandler) VerifyManifest(referralId int, origin string, listing DownloadListing) error {
+	if listing.Manifest == "" || listing.ManifestSignature == "" {
+		return fmt.Errorf("%w: referral has no signed manifest", ErrManifestInvalid)
+	}
+	// issued to the origin, checked when fetched
+	cert, err := ph.HospitalCertificate(origin)
+	if err != nil {
+		return err
+	}
+	err = lib.VerifySignature(cert, listing.Manifest, listing.ManifestSignature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrManifestInvalid, err)
+	}
+	manifest, err := lib.ParseManifest(listing.Manifest)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrManifestInvalid, err)
+	}
+	checksums := make(map[string]string, len(listing.Files))
+	for _, file := range listing.Files {
+		checksums[file.Name] = file.Checksum
+	}
+	if manifest.ReferralId != referralId || manifest.Origin != origin || !manifest.Matches(checksums) {
+		return fmt.Errorf("%w: files do not match the manifest", ErrManifestInvalid)
+	}
+	return nil
+}
+
+// Statement of the files this hospital downloaded and decrypted, sent when completing
+func (ph *PollingHandler) signReceipt(referralId int, destination string) (receipt string, signature string, err error) {
+	files, ok := ph.Database.GetFilesByReferral(referralId)
+	if !ok {
+		return "", "", fmt.Errorf("could not get files for referral '%d'", referralId)
+	}
+	r := lib.Receipt{
+		ReferralId:  referralId,
+		Destination: destination,
+		Timestamp:   time.Now().Unix(),
+	}
+	for _, file := range files {
+		if file.DownloadStatus != db.CompleteDownload {
+			return "", "", fmt.Errorf("file '%s' is not complete: %s", file.Name, file.DownloadStatus)
+		}
+		r.Files = append(r.Files, lib.ManifestFile{Name: file.Name, Checksum: file.Checksum})
+	}
+	privateKey, err := ph.privateKey()
+	if err != nil {
+		return
+	}
+	return lib.SignReceipt(privateKey, r)
+}
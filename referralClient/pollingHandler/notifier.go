@@ -0,0 +1,101 @@
+package pollinghandler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"simplemts/lib"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mail/mail"
+)
+
+// Plain text notification for doctors or staff
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+type Notifier interface {
+	Notify(message Message) error
+}
+
+// Sends notifications through an SMTP server
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (n SMTPNotifier) Notify(message Message) error {
+	m := mail.NewMessage()
+	m.SetHeader("From", n.From)
+	m.SetHeader("To", message.To...)
+	m.SetHeader("Subject", message.Subject)
+	m.SetBody("text/plain", message.Body)
+	d := mail.NewDialer(n.Host, n.Port, n.Username, n.Password)
+	return d.DialAndSend(m)
+}
+
+// Writes notifications to a file or stdout, for development
+type LogNotifier struct {
+	Writer io.Writer
+	mu     sync.Mutex
+}
+
+func (n *LogNotifier) Notify(message Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := fmt.Fprintf(n.Writer, "--- %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC3339), strings.Join(message.To, ", "), message.Subject, message.Body)
+	return err
+}
+
+// Notifier selected by NOTIFIER, smtp or log (default); smtp needs its server and the recipients
+func NewNotifier() (Notifier, error) {
+	switch kind := lib.GetEnv("NOTIFIER", "log"); kind {
+	case "smtp":
+		notifier := SMTPNotifier{
+			Host:     lib.GetEnv("SMTP_HOST", ""),
+			Port:     lib.GetEnvAsInt("SMTP_PORT", 587),
+			Username: lib.GetEnv("SMTP_USERNAME", ""),
+			Password: lib.GetEnv("SMTP_PASSWORD", ""),
+			From:     lib.GetEnv("SMTP_FROM", ""),
+		}
+		if notifier.Host == "" || notifier.From == "" {
+			return nil, errors.New("SMTP_HOST and SMTP_FROM are required")
+		}
+		// every referral would stay pending on a send without recipients
+		if recipients(lib.GetEnv("NOTIFY_DOCTOR_EMAIL", "")) == nil || recipients(lib.GetEnv("NOTIFY_STAFF_EMAIL", "")) == nil {
+			return nil, errors.New("NOTIFY_DOCTOR_EMAIL and NOTIFY_STAFF_EMAIL are required")
+		}
+		return notifier, nil
+	case "log":
+		logFile := lib.GetEnv("NOTIFY_LOG_FILE", "")
+		if logFile == "" {
+			return &LogNotifier{Writer: os.Stdout}, nil
+		}
+		f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &LogNotifier{Writer: f}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", kind)
+	}
+}
+
+func recipients(list string) (to []string) {
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+	return
+}
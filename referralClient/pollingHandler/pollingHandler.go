@@ -1,26 +1,22 @@
 package pollinghandler
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
 	"path"
 	"simplemts/lib"
 	db "simplemts/lib/database"
 	"slices"
-	"sync"
 	"time"
 )
 
-const DISABLE_EMAIL = false
-
 type PollingHandler struct {
 	client             lib.Requester
 	serverURL          string
@@ -31,13 +27,35 @@ type PollingHandler struct {
 	resultDir          string
 	originPayloadDir   string
 	uploadDir          string
+	chunkSize          int64
+	uploadParallel     int
+	maxUploadFailures  int
+	keyFile            string
+	certFile           string
+	caFile             string
 	staffGrantEmail    map[int]bool
 	staffCompleteEmail map[int]bool
 	docCompleteEmail   map[int]bool
 	docNotGrantEmail   map[int]bool
+	docExpiredEmail    map[int]bool
+	staffCancelEmail   map[int]bool
+	staffClaimedEmail  map[int]bool
+	cancelPurged       map[int]bool
+	// reminders for urgent referrals waiting for a grant
+	escalationInterval map[db.Urgency]time.Duration
+	lastEscalation     map[int]time.Time
+	// referrals the client keeps working on until they change or their handling succeeds, by direction
+	pending map[string]map[int]PollData
+	resumed bool
+	// where doctor and staff emails go, DISABLE_EMAIL turns them off
+	Notifier     Notifier
+	disableEmail bool
+	doctorEmail  []string
+	staffEmail   []string
 }
 
-func NewPollingHandler(duration_s int, client lib.Requester, database *db.Database, serverURL string) (ph PollingHandler) {
+// Fails on a notifier config error, referrals would otherwise be marked notified without any email sent
+func NewPollingHandler(duration_s int, client lib.Requester, database *db.Database, serverURL string) (ph PollingHandler, err error) {
 	handler := PollingHandler{
 		duration_s:         duration_s,
 		client:             client,
@@ -46,27 +64,66 @@ func NewPollingHandler(duration_s int, client lib.Requester, database *db.Databa
 		serverURL:          serverURL,
 		destPayloadDir:     lib.GetEnv("DEST_PAYLOAD_DIR", "../../client/download"),
 		resultDir:          lib.GetEnv("DEST_RESULT_DIR", "../../client/download-result"),
-		originPayloadDir:   lib.GetEnv("ORIGIN_PAYLOAD_DIR", "../../client-upload"),
+		originPayloadDir:   lib.GetEnv("ORIGIN_PAYLOAD_DIR", "../../client-payload"),
 		uploadDir:          lib.GetEnv("ORIGIN_UPLOAD_DIR", "../../client-upload"),
+		chunkSize:          int64(lib.GetEnvAsInt("UPLOAD_CHUNK_KB", 1024)) * 1024,
+		uploadParallel:     lib.GetEnvAsInt("UPLOAD_PARALLEL", 4),
+		maxUploadFailures:  lib.GetEnvAsInt("UPLOAD_MAX_FAILURES", 3),
+		keyFile:            path.Join(lib.GetEnv("AUTH_DIR", "./auth"), lib.GetEnv("KEY_FILE", "./origin.key")),
+		certFile:           path.Join(lib.GetEnv("AUTH_DIR", "./auth"), lib.GetEnv("CERT_FILE", "./origin.crt")),
+		caFile:             path.Join(lib.GetEnv("AUTH_DIR", "./auth"), lib.GetEnv("CA_FILE", "./ca.crt")),
 		staffGrantEmail:    map[int]bool{},
 		staffCompleteEmail: map[int]bool{},
 		docCompleteEmail:   map[int]bool{},
 		docNotGrantEmail:   map[int]bool{},
+		docExpiredEmail:    map[int]bool{},
+		staffCancelEmail:   map[int]bool{},
+		staffClaimedEmail:  map[int]bool{},
+		cancelPurged:       map[int]bool{},
+		escalationInterval: map[db.Urgency]time.Duration{
+			db.Emergency: time.Duration(lib.GetEnvAsInt("ESCALATE_EMERGENCY_MIN", 15)) * time.Minute,
+			db.Urgent:    time.Duration(lib.GetEnvAsInt("ESCALATE_URGENT_MIN", 120)) * time.Minute,
+		},
+		lastEscalation: map[int]time.Time{},
+		pending: map[string]map[int]PollData{
+			"incoming": {},
+			"outgoing": {},
+		},
+		disableEmail: lib.GetEnvAsBool("DISABLE_EMAIL", false),
+		doctorEmail:  recipients(lib.GetEnv("NOTIFY_DOCTOR_EMAIL", "")),
+		staffEmail:   recipients(lib.GetEnv("NOTIFY_STAFF_EMAIL", "")),
+	}
+	handler.Notifier, err = NewNotifier()
+	if err != nil {
+		return handler, fmt.Errorf("notifier config error: %s", err)
 	}
 	handler.clearEmail()
-	return handler
+	return handler, nil
 }
 
+// Changes are pushed over the /events stream, the ticker polls while the stream is down
+// and otherwise only retries pending work
 func (ph *PollingHandler) Run() {
 	ticker := time.NewTicker(time.Second * time.Duration(ph.duration_s))
 	ph.tickerPaused = false
+	events := make(chan StreamEvent)
+	streaming := make(chan bool)
+	go ph.stream(events, streaming)
+	isStreaming := false
 	done := make(chan bool)
 	for {
 		select {
 		case <-done:
 			return
+		case isStreaming = <-streaming:
+		case event := <-events:
+			ph.HandleEvent(event)
 		case <-ticker.C:
-			ph.HandleTick()
+			if isStreaming {
+				ph.HandlePending()
+			} else {
+				ph.HandleTick()
+			}
 		}
 	}
 }
@@ -74,6 +131,22 @@ func (ph *PollingHandler) Run() {
 type PollData = struct {
 	Id             int               `json:"Id" validate:"required"`
 	ReferralStatus db.ReferralStatus `json:"ReferralStatus" validate:"required"`
+	Origin         string            `json:"Origin"`
+	Destination    string            `json:"Destination"`
+	DeclineCode    db.DeclineCode    `json:"DeclineCode"`
+	DeclineReason  string            `json:"DeclineReason"`
+	// Set for a broadcast referral
+	CandidateStatus db.CandidateStatus `json:"CandidateStatus"`
+	Urgency         db.Urgency         `json:"Urgency"`
+	Deadline        int64              `json:"Deadline"`
+	Seq             int64              `json:"Seq"`
+}
+
+// Statuses the client acts on again every tick until the referral moves on:
+// uploads and downloads are retried, urgent grants are escalated
+var retryStatuses = map[string][]db.ReferralStatus{
+	"incoming": {db.Consented, db.UploadComplete, db.CounterUploadComplete},
+	"outgoing": {db.Granted, db.CounterCreated, db.UploadIncomplete, db.CounterUploadIncomplete},
 }
 
 func (ph *PollingHandler) requestDecode(path string, targetCode int, response any) (err error) {
@@ -97,35 +170,115 @@ func (ph *PollingHandler) HandleTick() {
 	// }
 	ph.tickerPaused = true // "Soft" Process locking
 
-	response := struct {
-		Referrals []PollData `json:"referrals" validate:"required"`
-	}{}
-
-	err := ph.requestDecode("/incoming", 200, &response)
+	if !ph.resumed {
+		err := ph.resume()
+		if err != nil {
+			fmt.Println("Could not resume pending referrals:", err)
+			ph.tickerPaused = false
+			return
+		}
+	}
+	err := ph.pollDirection("incoming")
 	if err != nil {
 		fmt.Println("Could not get incoming requests from server:", err)
 		ph.tickerPaused = false
 		return
 	}
-	// Use response
-	for _, val := range response.Referrals {
-		ph.HandleIncoming(val)
-	}
-
-	err = ph.requestDecode("/outgoing", 200, &response)
+	err = ph.pollDirection("outgoing")
 	if err != nil {
 		fmt.Println("Could not get outgoing requests from server:", err)
 		ph.tickerPaused = false
 		return
 	}
-	// Use response
-	for _, val := range response.Referrals {
-		ph.HandleOutgoing(val)
-	}
 
 	ph.tickerPaused = false // TODO Or not
 }
 
+func (ph *PollingHandler) pollChanges(direction string, since int64) (changed []PollData, cursor int64, err error) {
+	response := struct {
+		Referrals []PollData `json:"referrals" validate:"required"`
+		Cursor    int64      `json:"cursor"`
+	}{}
+	err = ph.requestDecode(fmt.Sprintf("/%s?since=%d", direction, since), 200, &response)
+	if err != nil {
+		return nil, since, err
+	}
+	return response.Referrals, response.Cursor, nil
+}
+
+// Handles referrals changed since the stored cursor, then pending ones that did not change
+func (ph *PollingHandler) pollDirection(direction string) (err error) {
+	since := ph.Database.GetPollCursor(direction)
+	changed, cursor, err := ph.pollChanges(direction, since)
+	if err != nil {
+		return err
+	}
+	handled := map[int]bool{}
+	for _, data := range changed {
+		ph.handleChange(direction, data)
+		handled[data.Id] = true
+	}
+	ph.handlePending(direction, handled)
+	if cursor != since && !ph.Database.SetPollCursor(direction, cursor) {
+		return fmt.Errorf("could not store %s cursor", direction)
+	}
+	return nil
+}
+
+// Handles a changed referral, it stays pending while the client still has work on it
+// or handling failed
+func (ph *PollingHandler) handleChange(direction string, data PollData) {
+	err := ph.handle(direction, data)
+	delete(ph.pending[direction], data.Id)
+	if err != nil || slices.Contains(retryStatuses[direction], data.ReferralStatus) {
+		ph.pending[direction][data.Id] = data
+	}
+}
+
+func (ph *PollingHandler) handlePending(direction string, skip map[int]bool) {
+	for id, data := range ph.pending[direction] {
+		if skip[id] {
+			continue
+		}
+		err := ph.handle(direction, data)
+		if err == nil && !slices.Contains(retryStatuses[direction], data.ReferralStatus) {
+			delete(ph.pending[direction], id)
+		}
+	}
+}
+
+func (ph *PollingHandler) handle(direction string, data PollData) (err error) {
+	if direction == "incoming" {
+		err = ph.HandleIncoming(data)
+	} else {
+		err = ph.HandleOutgoing(data)
+	}
+	if err != nil {
+		fmt.Printf("Could not handle %s referral %d: %s\n", direction, data.Id, err)
+	}
+	return
+}
+
+// Work in progress before a restart is behind the stored cursor, pick it up from a full listing
+func (ph *PollingHandler) resume() (err error) {
+	for direction, pending := range ph.pending {
+		if ph.Database.GetPollCursor(direction) == 0 {
+			continue
+		}
+		all, _, err := ph.pollChanges(direction, 0)
+		if err != nil {
+			return err
+		}
+		for _, data := range all {
+			if slices.Contains(retryStatuses[direction], data.ReferralStatus) {
+				pending[data.Id] = data
+			}
+		}
+	}
+	ph.resumed = true
+	return nil
+}
+
 // func checksumBlock(inpath string, blockSize int64) (checksum string, err error) {
 // 	hash := sha256.New()
 // 	out, err := os.Open(inpath)
@@ -154,37 +307,12 @@ func checksumFile(inpath string) (checksum string, err error) {
 	return
 }
 
-func fileEncrypt(filePath string, outpath string, secretKey []byte) (err error) {
-	block, err := aes.NewCipher(secretKey)
-	if err != nil {
-		return
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return
-	}
-	plainText, err := os.ReadFile(filePath)
-	if err != nil {
-		return
-	}
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return
-	}
-	cipherText := gcm.Seal(nonce, nonce, plainText, nil)
-	f, err := lib.CreateFile(outpath)
-	if err != nil {
-		return
-	}
-	f.Write(cipherText)
-	return
-}
-
-func encryptPayload(uploadDir string, payloadDir string, referralId int) (
+func encryptPayload(uploadDir string, payloadDir string, referralId int, destCert *x509.Certificate) (
 	result struct {
-		PayloadKey string          `json:"PayloadKey"`
-		Files      []db.FileObject `json:"Files" validate:"required,unique=Name,dive"`
+		PayloadKey        string          `json:"PayloadKey"`
+		Files             []db.FileObject `json:"Files" validate:"required,unique=Name,dive"`
+		Manifest          string          `json:"Manifest"`
+		ManifestSignature string          `json:"ManifestSignature"`
 	},
 	err error,
 ) {
@@ -193,7 +321,11 @@ func encryptPayload(uploadDir string, payloadDir string, referralId int) (
 	if err != nil {
 		return
 	}
-	result.PayloadKey = hex.EncodeToString(key) // TODO encrypt
+	// Only the destination can unwrap the key
+	result.PayloadKey, err = lib.WrapKey(destCert, key)
+	if err != nil {
+		return
+	}
 	// get files
 	referralUploadDir := path.Join(uploadDir, fmt.Sprint(referralId))
 	referralPayloadDir := path.Join(payloadDir, fmt.Sprint(referralId))
@@ -204,7 +336,7 @@ func encryptPayload(uploadDir string, payloadDir string, referralId int) (
 	}
 	// TODO danger, listing ReferralData.json and [any] together, can error same name
 	for _, file := range fileListing {
-		err = fileEncrypt(path.Join(referralUploadDir, "files", file.Name()), path.Join(referralPayloadDir, file.Name()), key)
+		err = FileEncrypt(path.Join(referralUploadDir, "files", file.Name()), path.Join(referralPayloadDir, file.Name()), key)
 		if err != nil {
 			return
 		}
@@ -222,71 +354,51 @@ func encryptPayload(uploadDir string, payloadDir string, referralId int) (
 	return
 }
 
-// func makeChunks(uploadDir string, referralId int) {
-// 	uDir := path.Join(uploadDir, fmt.Sprint(referralId))
-// 	// files
-// 	fileListing, err := os.ReadDir(path.Join(uDir, "encryption"))
-// 	if err != nil {
-// 		return
-// 	}
-// 	// TODO danger, listing ReferralData.json and [any] together, can error same name
-// 	// for _, file := range fileListing {
-// 	file := fileListing[0]
-// 	f, err := os.Open(path.Join(uDir, "encryption", file.Name()))
-// 	if err != nil {
-// 		fmt.Fprintln(os.Stderr, err)
-// 		return
-// 	}
-// 	defer f.Close()
-// 	stride := 1 << 20 // block = 1MB 1 << 20
-// 	r := bufio.NewReader(f)
-// 	buf := make([]byte, 0, stride)
-// 	for {
-// 		n, err := io.ReadFull(r, buf[:cap(buf)])
-// 		buf = buf[:n]
-// 		if err != nil {
-// 			if err == io.EOF {
-// 				break
-// 			}
-// 			if err != io.ErrUnexpectedEOF {
-// 				fmt.Fprintln(os.Stderr, err)
-// 				break
-// 			}
-// 		}
-
-// 		fmt.Println("read n bytes...", n)
-// 		// process buf
-// 	}
-// 	// }
-// }
-
-func (ph *PollingHandler) HandleOutgoing(data PollData) {
+// An error keeps the referral pending, uploads are retried by status instead
+func (ph *PollingHandler) HandleOutgoing(data PollData) error {
 	// Handle 1 outgoing
 	referralId := data.Id
 	referralPayloadDir := path.Join(ph.originPayloadDir, fmt.Sprintf("%d", referralId))
 	switch data.ReferralStatus {
-	case db.Granted:
+	case db.Granted, db.CounterCreated:
 		fmt.Println("Granted", referralId)
-		_, err := os.Stat(referralPayloadDir)
-		if err == nil {
-			// no errors
+		// The server leaves this status once the upload is initiated,
+		// a local payload while it has not is left from a failed attempt and encrypted again
+		status, _, err := ph.uploadStatus(referralId)
+		if err != nil {
+			fmt.Println("Could not get upload status: ", err)
+			break
+		}
+		if status != data.ReferralStatus {
 			fmt.Println("already uploaded")
 			break
 		}
-		if !os.IsNotExist(err) {
-			// other error
-			fmt.Println(err)
+		err = os.RemoveAll(referralPayloadDir)
+		if err != nil {
+			fmt.Println("Could not remove stale payload: ", err)
 			break
 		}
-		// dir not found
-		fetchfiles, err := encryptPayload(ph.uploadDir, ph.originPayloadDir, referralId)
+		destCert, err := ph.HospitalCertificate(data.Destination)
+		if err != nil {
+			fmt.Println("Could not get destination key: ", err)
+			break
+		}
+		fetchfiles, err := encryptPayload(ph.uploadDir, ph.originPayloadDir, referralId, destCert)
 		if err != nil {
 			fmt.Println(err)
+			os.RemoveAll(referralPayloadDir)
+			break
+		}
+		fetchfiles.Manifest, fetchfiles.ManifestSignature, err = ph.signManifest(referralId, data.Origin, fetchfiles.Files)
+		if err != nil {
+			fmt.Println("Could not sign manifest: ", err)
+			os.RemoveAll(referralPayloadDir)
 			break
 		}
 		fileString, err := json.Marshal(fetchfiles)
 		if err != nil {
 			fmt.Println(err)
+			os.RemoveAll(referralPayloadDir)
 			break
 		}
 		resp, code, err := ph.client.MakeJsonRequest(
@@ -294,167 +406,138 @@ func (ph *PollingHandler) HandleOutgoing(data PollData) {
 			string(fileString))
 		if err != nil {
 			fmt.Println("file upload init error: ", err)
+			os.RemoveAll(referralPayloadDir)
 			break
 		}
 		if code != 201 {
 			fmt.Println("Could not upload files ", code, resp)
 			os.RemoveAll(referralPayloadDir)
 		}
-	case db.UploadIncomplete:
+	case db.UploadIncomplete, db.CounterUploadIncomplete:
 		fmt.Println("Begin Upload")
-		// chunk begin
-		request := struct {
-			ChunkFiles []db.ChunkFile `json:"ChunkFiles"`
-		}{}
-		fileListing, err := os.ReadDir(referralPayloadDir)
+		err := ph.uploadPayload(referralId, referralPayloadDir)
 		if err != nil {
-			fmt.Println(err)
-			break
-		}
-		for _, files := range fileListing {
-			checksum, err := checksumFile(path.Join(referralPayloadDir, files.Name()))
-			if err != nil {
-				fmt.Println(err)
-				break
+			fmt.Println("Chunk upload error: ", err)
+			failures := ph.Database.GetUploadFailures(referralId) + 1
+			if !ph.Database.SetUploadFailures(referralId, failures) {
+				fmt.Println("Could not store upload failures: ", referralId)
 			}
-			chunk := db.ChunkFile{
-				Name: files.Name(),
-				Chunks: []db.Chunk{
-					{
-						Checksum: checksum,
-						SizeKB:   1,
-					},
-				},
-			}
-			request.ChunkFiles = append(request.ChunkFiles, chunk)
-		}
-		chunkJson, err := json.Marshal(request)
-		if err != nil {
-			fmt.Println(err)
-		}
-		resp, code, err := ph.client.MakeJsonRequest(
-			fmt.Sprintf(ph.serverURL+"/%d/upload/begin", referralId),
-			string(chunkJson))
-		if err != nil {
-			fmt.Println("chunk begin error: ", err)
-			break
-		}
-		if code != 201 {
-			fmt.Println("Could not chunk begin files ", code, resp)
-			break
-		}
-		for _, file := range fileListing {
-			f, err := os.Open(path.Join(referralPayloadDir, file.Name()))
-			if err != nil {
-				fmt.Println("chunk begin error: ", err)
+			if failures < ph.maxUploadFailures {
 				break
 			}
-			defer f.Close()
-			resp, code, err := ph.client.MakePostBinary(fmt.Sprintf(ph.serverURL+"/%d/upload/file/%s/0", referralId, file.Name()), f)
+			// Start over, payload is encrypted again when Granted
+			err = ph.abortUpload(referralId, referralPayloadDir)
 			if err != nil {
-				fmt.Println("chunk upload error: ", err)
-				break
-			}
-			if code != 200 {
-				fmt.Println("Chunk upload error: ", code, resp)
+				fmt.Println("Upload abort error: ", err)
 				break
 			}
-		}
-		resp, code, err = ph.client.MakeJsonRequest(fmt.Sprintf(ph.serverURL+"/%d/upload/complete", referralId), "")
-		if err != nil {
-			fmt.Println("chunk completion error: ", err)
-			break
-		}
-		if code != 200 {
-			fmt.Println("Chunk completion error: ", code, resp)
+			ph.Database.SetUploadFailures(referralId, 0)
 			break
 		}
+		ph.Database.SetUploadFailures(referralId, 0)
 		fmt.Println("Chunk upload complete")
 	case db.Complete:
-		if DISABLE_EMAIL {
-			return
-		}
-		if _, has := ph.docCompleteEmail[referralId]; has {
-			return
+		err := ph.notifyOnce(ph.docCompleteEmail, referralId, func() error {
+			_, dest, patientName, date := ph.getEmailInfo(referralId)
+			return ph.emailDocComplete("test", patientName, referralId, date, dest)
+		})
+		if err != nil {
+			return err
 		}
-		_, dest, patientName, date := ph.getEmailInfo(false, referralId)
-		emailDocComplete("test", patientName, referralId, date, dest)
-		ph.docCompleteEmail[referralId] = true
 	case db.NotGranted:
-		if DISABLE_EMAIL {
-			return
+		err := ph.notifyOnce(ph.docNotGrantEmail, referralId, func() error {
+			_, dest, patientName, date := ph.getEmailInfo(referralId)
+			return ph.emailDocNotGrant("test", patientName, referralId, date, dest, data.DeclineCode, data.DeclineReason)
+		})
+		if err != nil {
+			return err
 		}
-		if _, has := ph.docNotGrantEmail[referralId]; has {
-			return
+	case db.Expired:
+		err := ph.notifyOnce(ph.docExpiredEmail, referralId, func() error {
+			_, dest, patientName, date := ph.getEmailInfo(referralId)
+			return ph.emailDocExpired("test", patientName, referralId, date, dest)
+		})
+		if err != nil {
+			return err
+		}
+	case db.Cancelled:
+		if ph.cancelPurged[referralId] {
+			return nil
+		}
+		ph.Database.SetUploadFailures(referralId, 0)
+		err := os.RemoveAll(referralPayloadDir)
+		if err != nil {
+			return fmt.Errorf("could not remove payload: %s", err)
 		}
-		_, dest, patientName, date := ph.getEmailInfo(false, referralId)
-		emailDocNotGrant("test", patientName, referralId, date, dest)
-		ph.docNotGrantEmail[referralId] = true
+		ph.cancelPurged[referralId] = true
 	}
+	return nil
 }
 
-func fileDecrypt(inpath string, outPath string, secretKey []byte) (err error) {
-	cipherText, err := os.ReadFile(inpath)
-	if err != nil {
+// Reminds staff of an emergency or urgent referral still waiting for a grant,
+// routine referrals are not escalated
+func (ph *PollingHandler) escalate(data PollData) {
+	interval, ok := ph.escalationInterval[data.Urgency]
+	if !ok {
 		return
 	}
-	block, err := aes.NewCipher([]byte(secretKey))
-	if err != nil {
+	if last, has := ph.lastEscalation[data.Id]; has && time.Since(last) < interval {
 		return
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
+	origin, dest, _, date := ph.getEmailInfo(data.Id)
+	if err := ph.emailStaffEscalate(data.Id, date, dest, origin, data.Urgency, time.Unix(data.Deadline, 0)); err != nil {
+		fmt.Println(err)
 		return
 	}
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := cipherText[:nonceSize], cipherText[nonceSize:]
-	plaintext, err := gcm.Open(nil, []byte(nonce), []byte(ciphertext), nil)
+	ph.lastEscalation[data.Id] = time.Now()
+}
+
+// Whether the destination granted the referral at some point, from the referral history
+func (ph *PollingHandler) wasGranted(referralId int) (granted bool, err error) {
+	response := struct {
+		Events []db.ReferralEvent `json:"events" validate:"required"`
+	}{}
+	err = ph.requestDecode(fmt.Sprintf("/%d/history", referralId), 200, &response)
 	if err != nil {
 		return
 	}
-	f, err := lib.CreateFile(outPath)
+	granted = slices.ContainsFunc(response.Events, func(event db.ReferralEvent) bool {
+		return event.ToStatus == db.Granted
+	})
+	return
+}
+
+// Removes downloaded and decrypted payloads of a cancelled referral
+func (ph *PollingHandler) purgeDownload(referralId int) (err error) {
+	err = os.RemoveAll(path.Join(ph.destPayloadDir, fmt.Sprintf("referral-%d", referralId)))
 	if err != nil {
 		return
 	}
-	f.Write(plaintext)
+	err = os.RemoveAll(path.Join(ph.resultDir, fmt.Sprintf("referral-%d", referralId)))
 	if err != nil {
 		return
 	}
-	return
+	ph.Database.DeleteFilesByReferral(referralId)
+	return nil
 }
 
-func (ph *PollingHandler) getEmailInfo(isIncoming bool, referralId int) (origin string, dest string, fullName string, date string) {
-	// referral
-	type referral struct {
-		Id             int               `json:"Id" validate:"required"`
-		ReferralStatus db.ReferralStatus `json:"ReferralStatus" validate:"required"`
+func (ph *PollingHandler) getEmailInfo(referralId int) (origin string, dest string, fullName string, date string) {
+	targetReferral := struct {
 		db.PatientObject
 		Origin      string `json:"Origin" validate:"required"`
-		Destination string `json:"Destination" validate:"required"`
-		Reason      string `json:"Reason" validate:"required"`
+		Destination string `json:"Destination"`
 		Created     int64  `json:"Created" validate:"required"`
-	}
-	response := struct {
-		Referrals []referral `json:"referrals" validate:"required,dive"`
 	}{}
-	url := "/incoming"
-	if !isIncoming {
-		url = "/outgoing"
-	}
-	err := ph.requestDecode(url, 200, &response)
+	err := ph.requestDecode(fmt.Sprintf("/%d", referralId), 200, &targetReferral)
 	if err != nil {
-		fmt.Println("Could not get referrals", err)
+		fmt.Println("Could not get referral", err)
 		return
 	}
-	// hospital
-	// type hospitalSt struct {
-	// 	HospitalId   string `json:"HospitalId" validate:"required"`
-	// 	HospitalName string `json:"HospitalName" validate:"required"`
-	// }
 	hospitals := []db.Hospital{}
 	resp, code, err := ph.client.MakeGetRequestRaw(ph.serverURL + "/hospitals")
 	if err != nil {
 		fmt.Println("get hospital error, ", err)
+		return
 	}
 	if code != 200 {
 		fmt.Printf("could make request: %d %s\n", code, resp)
@@ -465,124 +548,120 @@ func (ph *PollingHandler) getEmailInfo(isIncoming bool, referralId int) (origin
 		fmt.Printf("could not decode request: %d %s\n", code, resp)
 		return
 	}
-	idx := slices.IndexFunc(response.Referrals, func(r referral) bool {
-		return r.Id == referralId
-	})
-	targetReferral := response.Referrals[idx]
-	didx := slices.IndexFunc(hospitals, func(r db.Hospital) bool {
+	// hospital id if the directory does not list it, broadcast referrals have no destination yet
+	dest, origin = targetReferral.Destination, targetReferral.Origin
+	if didx := slices.IndexFunc(hospitals, func(r db.Hospital) bool {
 		return r.HospitalId == targetReferral.Destination
-	})
-	dest = hospitals[didx].HospitalName
-	oidx := slices.IndexFunc(hospitals, func(r db.Hospital) bool {
+	}); didx >= 0 {
+		dest = hospitals[didx].HospitalName
+	}
+	if oidx := slices.IndexFunc(hospitals, func(r db.Hospital) bool {
 		return r.HospitalId == targetReferral.Origin
-	})
-	origin = hospitals[oidx].HospitalName
-	// fmt.Println(targetReferral.FirstName, targetReferral.Id, targetReferral.Created, targetHospital.HospitalName)
+	}); oidx >= 0 {
+		origin = hospitals[oidx].HospitalName
+	}
 	fullName = fmt.Sprintf("%s %s %s", targetReferral.Prefix, targetReferral.FirstName, targetReferral.LastName)
 	date = time.Unix(targetReferral.Created, 0).Format("2006-01-02")
 	return
 }
 
-func (ph *PollingHandler) HandleIncoming(data PollData) {
+// An error keeps the referral pending, downloads are retried by status instead
+func (ph *PollingHandler) HandleIncoming(data PollData) error {
 	// Handle 1 incoming
 	referralId := data.Id
+	switch data.CandidateStatus {
+	case db.CandidateDeclined:
+		return nil
+	case db.CandidateUnavailable:
+		// Another hospital claimed the broadcast referral
+		err := ph.notifyOnce(ph.staffClaimedEmail, referralId, func() error {
+			origin, _, _, date := ph.getEmailInfo(referralId)
+			return ph.emailStaffUnavailable(referralId, date, origin)
+		})
+		if err != nil {
+			return err
+		}
+		return nil
+	}
 	switch data.ReferralStatus {
 	case db.Consented:
-		// Grant
-		if DISABLE_EMAIL {
-			return
+		// Grant, staff are reminded while it waits
+		if !ph.disableEmail && ph.staffGrantEmail[referralId] {
+			ph.escalate(data)
+			return nil
 		}
-		if _, has := ph.staffGrantEmail[referralId]; has {
-			return
+		err := ph.notifyOnce(ph.staffGrantEmail, referralId, func() error {
+			origin, dest, _, date := ph.getEmailInfo(referralId)
+			return ph.emailStaffGrant(referralId, date, dest, origin)
+		})
+		if err != nil {
+			return err
 		}
-		origin, dest, _, date := ph.getEmailInfo(true, referralId)
-		emailStaffGrant(referralId, date, dest, origin)
-		ph.staffGrantEmail[referralId] = true
+		ph.lastEscalation[referralId] = time.Now()
 	case db.Complete:
-		if DISABLE_EMAIL {
-			return
-		}
-		// Complete
-		if _, has := ph.staffCompleteEmail[referralId]; has {
-			return
-		}
-		origin, dest, _, date := ph.getEmailInfo(true, referralId)
-		emailStaffComplete(referralId, date, dest, origin)
-		ph.staffCompleteEmail[referralId] = true
-	case db.UploadComplete:
-		// Get files list
-		fileList, payloadKey, err := ph.DownloadList(referralId)
+		err := ph.notifyOnce(ph.staffCompleteEmail, referralId, func() error {
+			origin, dest, _, date := ph.getEmailInfo(referralId)
+			return ph.emailStaffComplete(referralId, date, dest, origin)
+		})
 		if err != nil {
-			fmt.Printf("Could not begin download: %s", err)
-			return
+			return err
 		}
-		// Check complete
-		downloadDir := path.Join(ph.destPayloadDir, fmt.Sprintf("referral-%d", referralId))
-		_, err = os.Stat(downloadDir)
-		if err != nil {
-			// open dir errors
-			if !os.IsNotExist(err) {
-				// other error
-				fmt.Println("download error: ", err)
-				break
-				// Dir not exist error, continue
+	case db.Cancelled:
+		if !ph.cancelPurged[referralId] {
+			err := ph.purgeDownload(referralId)
+			if err != nil {
+				return fmt.Errorf("could not remove payload: %s", err)
 			}
-		} else {
-			// Dir exists
-			dirsList, err := os.ReadDir(downloadDir)
+			ph.cancelPurged[referralId] = true
+		}
+		err := ph.notifyOnce(ph.staffCancelEmail, referralId, func() error {
+			// Staff only need to know if they already accepted the patient
+			granted, err := ph.wasGranted(referralId)
 			if err != nil {
-				fmt.Printf("Could not read download dir: %s", err)
-				return
+				return fmt.Errorf("could not get referral history: %s", err)
 			}
-			for _, fileItem := range fileList {
-				idx := slices.IndexFunc(dirsList, func(de fs.DirEntry) bool {
-					return de.Name() == fileItem.Name
-				})
-				if idx < 0 {
-					break // files not included
-				} else {
-					// Complete
-					fmt.Println("Download Complete for", referralId)
-					return
-				}
+			if !granted {
+				return nil
 			}
-			// Dir incomplete
+			origin, dest, _, date := ph.getEmailInfo(referralId)
+			return ph.emailStaffCancel(referralId, date, dest, origin)
+		})
+		if err != nil {
+			return err
 		}
-		// Download
-		var wg sync.WaitGroup
-
-		downloadpath := path.Join(
-			ph.destPayloadDir,
-			fmt.Sprintf("referral-%d", referralId),
-		)
-		for _, file := range fileList {
-			if file.UploadStatus == db.CompleteUpload {
-				// download complete files
-				wg.Add(1)
-				go func(filename string) {
-					defer wg.Done()
-					err := ph.DownloadFile(downloadpath, referralId, filename)
-					// fmt.Println(err)
-					if err != nil {
-						fmt.Println("Download error: ", err)
-					}
-				}(file.Name)
+	case db.UploadComplete, db.CounterUploadComplete:
+		err := ph.ReceivePayload(referralId, data.Origin)
+		if errors.Is(err, ErrManifestInvalid) {
+			fmt.Println("Rejecting referral: ", err)
+			resp, code, err := ph.client.MakeJsonRequest(ph.serverURL+fmt.Sprintf("/%d/reject", referralId), "")
+			if err != nil || code != 200 {
+				fmt.Println("Could not reject referral: ", code, resp, err)
 			}
+			return nil
 		}
-		wg.Wait()
-		decryptDir := path.Join(ph.resultDir, fmt.Sprintf("referral-%d", referralId))
-		decryptKey, err := hex.DecodeString(payloadKey)
+		if err != nil {
+			fmt.Println("Could not receive payload: ", err)
+			return nil
+		}
+		fmt.Println("Download Complete for", referralId)
+		request := struct {
+			Receipt          string `json:"Receipt"`
+			ReceiptSignature string `json:"ReceiptSignature"`
+		}{}
+		request.Receipt, request.ReceiptSignature, err = ph.signReceipt(referralId, data.Destination)
+		if err != nil {
+			fmt.Println("Could not sign receipt: ", err)
+			return nil
+		}
+		receiptJson, err := json.Marshal(request)
 		if err != nil {
 			fmt.Println(err)
-			break
+			return nil
 		}
-		for _, file := range fileList {
-			err := fileDecrypt(path.Join(downloadpath, file.Name), path.Join(decryptDir, file.Name), decryptKey)
-			if err != nil {
-				fmt.Println("decryption error", err)
-				break
-			}
+		resp, code, err := ph.client.MakeJsonRequest(ph.serverURL+fmt.Sprintf("/%d/complete", referralId), string(receiptJson))
+		if err != nil || code != 200 {
+			fmt.Println("Could not complete referral: ", code, resp, err)
 		}
-		ph.client.MakeJsonRequest(ph.serverURL+fmt.Sprintf("/%d/complete", referralId), "")
 	}
+	return nil
 }
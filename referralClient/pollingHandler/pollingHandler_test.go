@@ -1,16 +1,32 @@
 package pollinghandler_test
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"simplemts/lib"
 	db "simplemts/lib/database"
 	testhelper "simplemts/lib/testHelper"
 	pollinghandler "simplemts/referralClient/pollingHandler"
+	"strings"
 	"testing"
+	"time"
 )
 
 var database = db.NewDatabase("../../testing_client.sqlite")
 var mockRequester = testhelper.MockRequester{}
-var handler = pollinghandler.NewPollingHandler(
+var handler, _ = pollinghandler.NewPollingHandler(
 	1, &mockRequester, &database, "SERVER_URL")
 
 func TestHandleIncoming(t *testing.T) {
@@ -26,6 +42,198 @@ func TestHandleIncoming(t *testing.T) {
 	})
 }
 
+func TestHandleTick(t *testing.T) {
+	database.SetPollCursor("incoming", 3)
+	database.SetPollCursor("outgoing", 3)
+	mockRequester.ResponseStatus = 200
+	mockRequester.ResponseData = []byte(`{"referrals":[],"cursor":7}`)
+	handler.HandleTick()
+	t.Run("Since stored cursor", func(t *testing.T) {
+		wantUrl := "SERVER_URL/outgoing?since=3"
+		if mockRequester.RequestURL != wantUrl {
+			t.Errorf("Want %s, Got %s", wantUrl, mockRequester.RequestURL)
+		}
+	})
+	t.Run("Cursor stored", func(t *testing.T) {
+		for _, direction := range []string{"incoming", "outgoing"} {
+			if got := database.GetPollCursor(direction); got != 7 {
+				t.Errorf("Want %s cursor 7, Got %d", direction, got)
+			}
+		}
+	})
+}
+
+func TestListen(t *testing.T) {
+	database.SetPollCursor("incoming", 4)
+	database.SetPollCursor("outgoing", 6)
+	mockRequester.ResponseStatus = 200
+	mockRequester.ResponseData = []byte("retry: 5000\n\n" +
+		"id: 8\nevent: incoming\ndata: {\"Id\":1,\"ReferralStatus\":\"Created\",\"Seq\":8}\n\n" +
+		": keepalive\n\n" +
+		"id: 9\nevent: outgoing\ndata: {\"Id\":2,\"ReferralStatus\":\"Created\",\"Seq\":9}\n\n")
+	events := make(chan pollinghandler.StreamEvent, 10)
+	up := make(chan bool, 1)
+	err := handler.Listen(events, up)
+	close(events)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("Want %s, Got %v", io.EOF, err)
+	}
+	wantUrl := "SERVER_URL/events?since=4"
+	if mockRequester.RequestURL != wantUrl {
+		t.Errorf("Want %s, Got %s", wantUrl, mockRequester.RequestURL)
+	}
+	got := []pollinghandler.StreamEvent{}
+	for event := range events {
+		got = append(got, event)
+	}
+	if len(got) != 2 || got[0].Direction != "incoming" || got[0].Data.Seq != 8 ||
+		got[1].Direction != "outgoing" || got[1].Data.Id != 2 {
+		t.Errorf("Unexpected events: %v", got)
+	}
+}
+
+// Stream that sends one keepalive and then nothing, like a half-open connection
+type quietRequester struct {
+	testhelper.MockRequester
+}
+
+func (qr *quietRequester) MakeGetRequestRaw(URL string) (io.ReadCloser, int, error) {
+	if !strings.Contains(URL, "/events") {
+		return qr.MockRequester.MakeGetRequestRaw(URL)
+	}
+	reader, writer := io.Pipe()
+	go writer.Write([]byte(": keepalive\n\n"))
+	return reader, 200, nil
+}
+
+func TestListenTimeout(t *testing.T) {
+	t.Setenv("EVENTS_KEEPALIVE_S", "1")
+	quiet, _ := pollinghandler.NewPollingHandler(1, &quietRequester{}, &database, "SERVER_URL")
+	events := make(chan pollinghandler.StreamEvent, 1)
+	up := make(chan bool, 1)
+	done := make(chan error)
+	go func() { done <- quiet.Listen(events, up) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, pollinghandler.ErrStreamTimeout) {
+			t.Errorf("Want %s, Got %v", pollinghandler.ErrStreamTimeout, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Quiet stream still open")
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	database.SetPollCursor("incoming", 10)
+	t.Run("Already polled", func(t *testing.T) {
+		handler.HandleEvent(pollinghandler.StreamEvent{
+			Direction: "incoming",
+			Data:      pollinghandler.PollData{Id: 1, ReferralStatus: db.Created, Seq: 5},
+		})
+		if got := database.GetPollCursor("incoming"); got != 10 {
+			t.Errorf("Want cursor 10, Got %d", got)
+		}
+	})
+	t.Run("New change", func(t *testing.T) {
+		handler.HandleEvent(pollinghandler.StreamEvent{
+			Direction: "incoming",
+			Data:      pollinghandler.PollData{Id: 1, ReferralStatus: db.Created, Seq: 12},
+		})
+		if got := database.GetPollCursor("incoming"); got != 12 {
+			t.Errorf("Want cursor 12, Got %d", got)
+		}
+	})
+}
+
+type recordingNotifier struct {
+	messages []pollinghandler.Message
+	err      error
+}
+
+func (n *recordingNotifier) Notify(message pollinghandler.Message) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func TestNotifier(t *testing.T) {
+	defer func(notifier pollinghandler.Notifier) { handler.Notifier = notifier }(handler.Notifier)
+	mockRequester.ResponseStatus = 200
+	mockRequester.ResponseData = []byte("a")
+	pollData := pollinghandler.PollData{Id: 22345, ReferralStatus: db.Consented}
+	t.Run("Send failure", func(t *testing.T) {
+		handler.Notifier = &recordingNotifier{err: errors.New("connection refused")}
+		handler.HandleIncoming(pollData)
+	})
+	t.Run("Sent on next change", func(t *testing.T) {
+		recorder := &recordingNotifier{}
+		handler.Notifier = recorder
+		handler.HandleIncoming(pollData)
+		handler.HandleIncoming(pollData)
+		if len(recorder.messages) != 1 {
+			t.Fatalf("Want 1 message, Got %d", len(recorder.messages))
+		}
+		if !strings.Contains(recorder.messages[0].Subject, "(ID:22345)") {
+			t.Errorf("Unexpected subject: %s", recorder.messages[0].Subject)
+		}
+	})
+	t.Run("Retried while pending", func(t *testing.T) {
+		mockRequester.ResponseData = []byte(`{"referrals":[],"cursor":0}`)
+		handler.Notifier = &recordingNotifier{err: errors.New("connection refused")}
+		handler.HandleEvent(pollinghandler.StreamEvent{
+			Direction: "outgoing",
+			Data:      pollinghandler.PollData{Id: 22346, ReferralStatus: db.Complete, Seq: 1000},
+		})
+		recorder := &recordingNotifier{}
+		handler.Notifier = recorder
+		handler.HandlePending()
+		handler.HandlePending()
+		if len(recorder.messages) != 1 {
+			t.Fatalf("Want 1 message, Got %d", len(recorder.messages))
+		}
+		if !strings.Contains(recorder.messages[0].Subject, "(ID:22346)") {
+			t.Errorf("Unexpected subject: %s", recorder.messages[0].Subject)
+		}
+	})
+	t.Run("Log notifier", func(t *testing.T) {
+		out := bytes.Buffer{}
+		notifier := pollinghandler.LogNotifier{Writer: &out}
+		err := notifier.Notify(pollinghandler.Message{To: []string{"staff@example.com"}, Subject: "Subject", Body: "Body"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "To: staff@example.com\nSubject: Subject\n\nBody") {
+			t.Errorf("Unexpected log: %s", out.String())
+		}
+	})
+	t.Run("SMTP config", func(t *testing.T) {
+		t.Setenv("NOTIFIER", "smtp")
+		t.Setenv("SMTP_HOST", "")
+		if _, err := pollinghandler.NewNotifier(); err == nil {
+			t.Error("Want error without SMTP_HOST")
+		}
+		if _, err := pollinghandler.NewPollingHandler(1, &mockRequester, &database, "SERVER_URL"); err == nil {
+			t.Error("Want handler error without SMTP_HOST")
+		}
+		t.Setenv("SMTP_HOST", "localhost")
+		t.Setenv("SMTP_FROM", "referral@example.com")
+		if _, err := pollinghandler.NewNotifier(); err == nil {
+			t.Error("Want error without recipients")
+		}
+		t.Setenv("NOTIFY_DOCTOR_EMAIL", "doctor@example.com")
+		t.Setenv("NOTIFY_STAFF_EMAIL", "staff@example.com")
+		notifier, err := pollinghandler.NewNotifier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := notifier.(pollinghandler.SMTPNotifier).Port; got != 587 {
+			t.Errorf("Want port 587, Got %d", got)
+		}
+	})
+}
+
 // Download handler
 func TestHandleDownload(t *testing.T) {
 	t.Run("Normal", func(t *testing.T) {
@@ -40,7 +248,8 @@ func TestHandleDownload(t *testing.T) {
 				}
 			]
 		}`)
-		response, _, err := handler.DownloadList(referralId)
+		listing, err := handler.DownloadList(referralId)
+		response := listing.Files
 		wantUrl := fmt.Sprintf("SERVER_URL/%d/download", referralId)
 		gotUrl := mockRequester.RequestURL
 		if gotUrl != wantUrl {
@@ -64,6 +273,495 @@ func TestHandleDownload(t *testing.T) {
 	})
 }
 
+func TestDownloadFile(t *testing.T) {
+	referralId := 12345
+	t.Run("Resume", func(t *testing.T) {
+		downloadPath := t.TempDir()
+		os.WriteFile(path.Join(downloadPath, "a.part"), []byte("abc"), 0660)
+		mockRequester.ResponseStatus = 206
+		mockRequester.ResponseData = []byte("def")
+		err := handler.DownloadFile(downloadPath, referralId, "a", "checksum")
+		if err != nil {
+			t.Errorf("Error %s", err)
+			return
+		}
+		wantUrl := fmt.Sprintf("SERVER_URL/%d/download/a", referralId)
+		if mockRequester.RequestURL != wantUrl {
+			t.Errorf("Want %s, Got %s", wantUrl, mockRequester.RequestURL)
+		}
+		if mockRequester.RequestOffset != 3 {
+			t.Errorf("Want offset 3, Got %d", mockRequester.RequestOffset)
+		}
+		got, _ := os.ReadFile(path.Join(downloadPath, "a"))
+		if string(got) != "abcdef" {
+			t.Errorf("Want abcdef, Got %s", got)
+		}
+	})
+	t.Run("Restart", func(t *testing.T) {
+		downloadPath := t.TempDir()
+		os.WriteFile(path.Join(downloadPath, "a.part"), []byte("abc"), 0660)
+		mockRequester.ResponseStatus = 200
+		mockRequester.ResponseData = []byte("whole")
+		err := handler.DownloadFile(downloadPath, referralId, "a", "checksum")
+		if err != nil {
+			t.Errorf("Error %s", err)
+			return
+		}
+		got, _ := os.ReadFile(path.Join(downloadPath, "a"))
+		if string(got) != "whole" {
+			t.Errorf("Want whole, Got %s", got)
+		}
+	})
+	t.Run("Part complete", func(t *testing.T) {
+		downloadPath := t.TempDir()
+		os.WriteFile(path.Join(downloadPath, "a.part"), []byte("abc"), 0660)
+		sum := sha256.Sum256([]byte("abc"))
+		mockRequester.RequestURL = ""
+		mockRequester.ResponseStatus = 416
+		err := handler.DownloadFile(downloadPath, referralId, "a", hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Errorf("Error %s", err)
+			return
+		}
+		if mockRequester.RequestURL != "" {
+			t.Errorf("Want no request, Got %s", mockRequester.RequestURL)
+		}
+		got, _ := os.ReadFile(path.Join(downloadPath, "a"))
+		if string(got) != "abc" {
+			t.Errorf("Want abc, Got %s", got)
+		}
+	})
+}
+
+func TestDownloadVerified(t *testing.T) {
+	referralId := 12345
+	sum := sha256.Sum256([]byte("abc"))
+	checksum := hex.EncodeToString(sum[:])
+	t.Run("Normal", func(t *testing.T) {
+		downloadPath := t.TempDir()
+		mockRequester.ResponseStatus = 200
+		mockRequester.ResponseData = []byte("abc")
+		err := handler.DownloadVerified(downloadPath, referralId, pollinghandler.FileTracking{
+			Name:     "a",
+			Checksum: checksum,
+		})
+		if err != nil {
+			t.Errorf("Error %s", err)
+		}
+	})
+	t.Run("Checksum mismatch", func(t *testing.T) {
+		downloadPath := t.TempDir()
+		mockRequester.ResponseStatus = 200
+		mockRequester.ResponseData = []byte("abd")
+		err := handler.DownloadVerified(downloadPath, referralId, pollinghandler.FileTracking{
+			Name:     "a",
+			Checksum: checksum,
+		})
+		if !errors.Is(err, pollinghandler.ErrChecksumMismatch) {
+			t.Errorf("Want checksum mismatch, Got %v", err)
+		}
+		if _, err := os.Stat(path.Join(downloadPath, "a")); !os.IsNotExist(err) {
+			t.Errorf("Mismatching file was kept")
+		}
+	})
+}
+
+// Upload handler
+func TestMakeChunks(t *testing.T) {
+	t.Run("Normal", func(t *testing.T) {
+		data := make([]byte, 2500)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		filePath := path.Join(t.TempDir(), "a")
+		os.WriteFile(filePath, data, 0660)
+		chunks, err := pollinghandler.MakeChunks(filePath, 1024)
+		if err != nil {
+			t.Errorf("Error %s", err)
+			return
+		}
+		if len(chunks) != 3 {
+			t.Errorf("Want 3 chunks, Got %d", len(chunks))
+			return
+		}
+		for i, chunk := range chunks {
+			end := min((i+1)*1024, len(data))
+			sum := sha256.Sum256(data[i*1024 : end])
+			if chunk.Checksum != hex.EncodeToString(sum[:]) {
+				t.Errorf("Wrong checksum for chunk %d", i)
+			}
+			if chunk.SizeKB != 1 {
+				t.Errorf("Want SizeKB 1, Got %d", chunk.SizeKB)
+			}
+		}
+	})
+	t.Run("Empty", func(t *testing.T) {
+		filePath := path.Join(t.TempDir(), "a")
+		os.WriteFile(filePath, []byte{}, 0660)
+		chunks, err := pollinghandler.MakeChunks(filePath, 1024)
+		if err != nil {
+			t.Errorf("Error %s", err)
+			return
+		}
+		if len(chunks) != 1 {
+			t.Errorf("Want 1 chunk, Got %d", len(chunks))
+		}
+	})
+}
+
+func TestHandleGranted(t *testing.T) {
+	referralId := 32345
+	payloadDir := t.TempDir()
+	t.Setenv("ORIGIN_PAYLOAD_DIR", payloadDir)
+	origin, _ := pollinghandler.NewPollingHandler(1, &mockRequester, &database, "SERVER_URL")
+	referralPayloadDir := path.Join(payloadDir, fmt.Sprint(referralId))
+	os.MkdirAll(referralPayloadDir, 0750)
+	mockRequester.ResponseStatus = 200
+	t.Run("Initiated", func(t *testing.T) {
+		mockRequester.ResponseData = []byte(`{"ReferralStatus": "UploadIncomplete", "Files": []}`)
+		origin.HandleOutgoing(pollinghandler.PollData{Id: referralId, ReferralStatus: db.Granted})
+		if _, err := os.Stat(referralPayloadDir); err != nil {
+			t.Errorf("Want payload kept, Got %s", err)
+		}
+		wantUrl := fmt.Sprintf("SERVER_URL/%d/upload/status", referralId)
+		if mockRequester.RequestURL != wantUrl {
+			t.Errorf("Want %s, Got %s", wantUrl, mockRequester.RequestURL)
+		}
+	})
+	t.Run("Stale payload", func(t *testing.T) {
+		mockRequester.ResponseData = []byte(`{"ReferralStatus": "Granted", "Files": []}`)
+		origin.HandleOutgoing(pollinghandler.PollData{Id: referralId, ReferralStatus: db.Granted})
+		if _, err := os.Stat(referralPayloadDir); !os.IsNotExist(err) {
+			t.Errorf("Want stale payload removed, Got %v", err)
+		}
+	})
+	t.Run("Upload failures stored", func(t *testing.T) {
+		defer database.SetUploadFailures(referralId, 0)
+		mockRequester.ResponseData = []byte(`{"ReferralStatus": "UploadIncomplete", "Files": []}`)
+		origin.HandleOutgoing(pollinghandler.PollData{Id: referralId, ReferralStatus: db.UploadIncomplete})
+		if got := database.GetUploadFailures(referralId); got != 1 {
+			t.Errorf("Want 1 failure, Got %d", got)
+		}
+	})
+}
+
+func TestUploadStatus(t *testing.T) {
+	t.Run("Normal", func(t *testing.T) {
+		referralId := 12345
+		mockRequester.ResponseStatus = 200
+		mockRequester.ResponseData = []byte(`{
+			"ReferralStatus": "UploadIncomplete",
+			"Files" : [
+				{
+					"Name": "a",
+					"Checksum": "a",
+					"UploadStatus": "",
+					"Chunks": [
+						{"Checksum": "b", "SizeKB": 1, "Status": "Complete"},
+						{"Checksum": "c", "SizeKB": 1, "Status": "Incomplete"}
+					]
+				}
+			]
+		}`)
+		response, err := handler.UploadStatus(referralId)
+		wantUrl := fmt.Sprintf("SERVER_URL/%d/upload/status", referralId)
+		gotUrl := mockRequester.RequestURL
+		if gotUrl != wantUrl {
+			t.Errorf("Want %s, Got %s", wantUrl, gotUrl)
+		}
+		if err != nil {
+			t.Errorf("Error %s", err)
+			return
+		}
+		if len(response) != 1 || len(response[0].Chunks) != 2 {
+			t.Errorf("Wrong result: %v", response)
+			return
+		}
+		if response[0].Chunks[1].Status != pollinghandler.Incomplete {
+			t.Errorf("Wrong chunk status: %s", response[0].Chunks[1].Status)
+		}
+	})
+}
+
+// Encryption
+func encryptBytes(t *testing.T, data []byte, key []byte) (encPath string) {
+	dir := t.TempDir()
+	os.WriteFile(path.Join(dir, "plain"), data, 0660)
+	encPath = path.Join(dir, "enc")
+	err := pollinghandler.FileEncrypt(path.Join(dir, "plain"), encPath, key)
+	if err != nil {
+		t.Fatalf("Encrypt error %s", err)
+	}
+	return
+}
+
+func decryptBytes(encPath string, key []byte) ([]byte, error) {
+	outPath := encPath + ".out"
+	err := pollinghandler.FileDecrypt(encPath, outPath, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(outPath)
+}
+
+func TestEncryption(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	seg := pollinghandler.StreamSegmentSize
+	for _, size := range []int{0, 1, seg - 1, seg, seg + 1, 3 * seg} {
+		t.Run(fmt.Sprintf("Roundtrip %d", size), func(t *testing.T) {
+			data := make([]byte, size)
+			rand.Read(data)
+			got, err := decryptBytes(encryptBytes(t, data, key), key)
+			if err != nil {
+				t.Errorf("Decrypt error %s", err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Decrypted data differs")
+			}
+		})
+	}
+	t.Run("Single-shot payload", func(t *testing.T) {
+		data := []byte("old payload")
+		block, _ := aes.NewCipher(key)
+		gcm, _ := cipher.NewGCM(block)
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		encPath := path.Join(t.TempDir(), "enc")
+		os.WriteFile(encPath, gcm.Seal(nonce, nonce, data, nil), 0660)
+		got, err := decryptBytes(encPath, key)
+		if err != nil {
+			t.Errorf("Decrypt error %s", err)
+			return
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Decrypted data differs")
+		}
+	})
+
+	headerSize := 16
+	segmentSize := seg + 16
+	data := make([]byte, 3*seg+100)
+	rand.Read(data)
+	tamper := map[string]func([]byte) []byte{
+		"Reordered": func(enc []byte) []byte {
+			out := append([]byte{}, enc[:headerSize]...)
+			out = append(out, enc[headerSize+segmentSize:headerSize+2*segmentSize]...)
+			out = append(out, enc[headerSize:headerSize+segmentSize]...)
+			return append(out, enc[headerSize+2*segmentSize:]...)
+		},
+		"Truncated": func(enc []byte) []byte {
+			return enc[:headerSize+3*segmentSize]
+		},
+		"Modified": func(enc []byte) []byte {
+			enc[headerSize+10] ^= 1
+			return enc
+		},
+		"Modified header": func(enc []byte) []byte {
+			enc[12] ^= 1
+			return enc
+		},
+	}
+	for name, modify := range tamper {
+		t.Run(name, func(t *testing.T) {
+			encPath := encryptBytes(t, data, key)
+			enc, _ := os.ReadFile(encPath)
+			os.WriteFile(encPath, modify(enc), 0660)
+			_, err := decryptBytes(encPath, key)
+			if err == nil {
+				t.Errorf("Want error, Got none")
+			}
+			if _, err := os.Stat(encPath + ".out"); !os.IsNotExist(err) {
+				t.Errorf("Partial plaintext was kept")
+			}
+		})
+	}
+}
+
+func createCertificate(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	cert, privateKey, err := testhelper.CreateMockCertificate("destination")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, privateKey
+}
+
+func TestWrapKey(t *testing.T) {
+	cert, privateKey := createCertificate(t)
+	key := make([]byte, 32)
+	rand.Read(key)
+	t.Run("Roundtrip", func(t *testing.T) {
+		wrapped, err := lib.WrapKey(cert, key)
+		if err != nil {
+			t.Errorf("Wrap error %s", err)
+			return
+		}
+		got, err := lib.UnwrapKey(privateKey, wrapped)
+		if err != nil {
+			t.Errorf("Unwrap error %s", err)
+			return
+		}
+		if !bytes.Equal(got, key) {
+			t.Errorf("Unwrapped key differs")
+		}
+	})
+	t.Run("Wrong key", func(t *testing.T) {
+		_, otherKey := createCertificate(t)
+		wrapped, _ := lib.WrapKey(cert, key)
+		if _, err := lib.UnwrapKey(otherKey, wrapped); err == nil {
+			t.Errorf("Want error, Got none")
+		}
+	})
+	t.Run("Legacy hex key", func(t *testing.T) {
+		got, err := lib.UnwrapKey(privateKey, hex.EncodeToString(key))
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("Got %x %v, want %x", got, err, key)
+		}
+	})
+	t.Run("Certificate PEM", func(t *testing.T) {
+		parsed, err := lib.ParseCertificatePEM(lib.EncodeCertificatePEM(cert))
+		if err != nil {
+			t.Errorf("Parse error %s", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(cert)
+		if err = lib.VerifyCertificate(parsed, pool); err != nil {
+			t.Errorf("Verify error %s", err)
+		}
+		otherCert, _ := createCertificate(t)
+		if err = lib.VerifyCertificate(otherCert, pool); err == nil {
+			t.Errorf("Want error for untrusted certificate, Got none")
+		}
+	})
+}
+
+// Key directory listing cert for hospitalId, caCert is the only trusted CA
+func mockKeyDirectory(t *testing.T, hospitalId string, cert *x509.Certificate, caCert *x509.Certificate) (caFile string) {
+	caFile = path.Join(t.TempDir(), "ca.crt")
+	os.WriteFile(caFile, []byte(lib.EncodeCertificatePEM(caCert)), 0660)
+	keys, _ := json.Marshal([]lib.HospitalKey{{HospitalId: hospitalId, Certificate: lib.EncodeCertificatePEM(cert)}})
+	mockRequester.ResponseStatus = 200
+	mockRequester.ResponseData = keys
+	return caFile
+}
+
+func TestHospitalCertificate(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cert, _ := createCertificate(t)
+		caFile := mockKeyDirectory(t, "destination", cert, cert)
+		got, err := lib.FetchHospitalCertificate(&mockRequester, "SERVER_URL", caFile, "destination")
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		if !got.Equal(cert) {
+			t.Errorf("Got another certificate")
+		}
+	})
+	t.Run("Other hospital", func(t *testing.T) {
+		otherCert, _, err := testhelper.CreateMockCertificate("other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		caFile := mockKeyDirectory(t, "destination", otherCert, otherCert)
+		if _, err := lib.FetchHospitalCertificate(&mockRequester, "SERVER_URL", caFile, "destination"); err == nil {
+			t.Errorf("Want error for another hospital's certificate, Got none")
+		}
+	})
+}
+
+func TestManifest(t *testing.T) {
+	cert, privateKey := createCertificate(t)
+	manifest := lib.Manifest{
+		ReferralId: 12345,
+		Origin:     "origin",
+		Files: []lib.ManifestFile{
+			{Name: "a", Checksum: "1"},
+			{Name: "b", Checksum: "2"},
+		},
+	}
+	manifestJson, signature, err := lib.SignManifest(privateKey, manifest)
+	if err != nil {
+		t.Fatalf("Sign error %s", err)
+	}
+	t.Run("Valid", func(t *testing.T) {
+		if err := lib.VerifySignature(cert, manifestJson, signature); err != nil {
+			t.Errorf("Verify error %s", err)
+		}
+		parsed, err := lib.ParseManifest(manifestJson)
+		if err != nil {
+			t.Errorf("Parse error %s", err)
+			return
+		}
+		if !parsed.Matches(map[string]string{"a": "1", "b": "2"}) {
+			t.Errorf("Manifest does not match its files")
+		}
+	})
+	t.Run("Modified", func(t *testing.T) {
+		modified := strings.Replace(manifestJson, `"Checksum":"2"`, `"Checksum":"3"`, 1)
+		if err := lib.VerifySignature(cert, modified, signature); err == nil {
+			t.Errorf("Want error, Got none")
+		}
+	})
+	t.Run("Other origin", func(t *testing.T) {
+		otherCert, _ := createCertificate(t)
+		if err := lib.VerifySignature(otherCert, manifestJson, signature); err == nil {
+			t.Errorf("Want error, Got none")
+		}
+	})
+	t.Run("Swapped files", func(t *testing.T) {
+		for _, files := range []map[string]string{
+			{"a": "1"},
+			{"a": "1", "b": "3"},
+			{"a": "1", "b": "2", "c": "3"},
+		} {
+			if manifest.Matches(files) {
+				t.Errorf("%v matches manifest", files)
+			}
+		}
+	})
+}
+
+func TestVerifyManifest(t *testing.T) {
+	listing := func(t *testing.T, signer *rsa.PrivateKey) pollinghandler.DownloadListing {
+		manifestJson, signature, err := lib.SignManifest(signer, lib.Manifest{
+			ReferralId: 12345,
+			Origin:     "origin",
+			Files:      []lib.ManifestFile{{Name: "a", Checksum: "1"}},
+		})
+		if err != nil {
+			t.Fatalf("Sign error %s", err)
+		}
+		return pollinghandler.DownloadListing{
+			Manifest:          manifestJson,
+			ManifestSignature: signature,
+			Files:             []pollinghandler.FileTracking{{Name: "a", Checksum: "1"}},
+		}
+	}
+	verify := func(t *testing.T, signerId string) error {
+		cert, privateKey, err := testhelper.CreateMockCertificate(signerId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caFile := mockKeyDirectory(t, "origin", cert, cert)
+		t.Setenv("AUTH_DIR", path.Dir(caFile))
+		t.Setenv("CA_FILE", path.Base(caFile))
+		verifier, _ := pollinghandler.NewPollingHandler(1, &mockRequester, &database, "SERVER_URL")
+		return verifier.VerifyManifest(12345, "origin", listing(t, privateKey))
+	}
+	t.Run("Signed by origin", func(t *testing.T) {
+		if err := verify(t, "origin"); err != nil {
+			t.Errorf("Error %s", err)
+		}
+	})
+	t.Run("Signed by other hospital", func(t *testing.T) {
+		if err := verify(t, "other"); err == nil {
+			t.Errorf("Want error for another hospital's signature, Got none")
+		}
+	})
+}
+
 func TestChunkBegin(t *testing.T) {
 	t.Run("Normal", func(t *testing.T) {
 	})
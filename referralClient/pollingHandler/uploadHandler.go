@@ -0,0 +1,224 @@
+package pollinghandler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	db "simplemts/lib/database"
+	"sync"
+)
+
+// Upload state from the server, chunks are empty if the file is not tracked
+type UploadTracking = struct {
+	Name         string          `json:"Name"`
+	Checksum     string          `json:"Checksum"`
+	UploadStatus db.UploadStatus `json:"UploadStatus"`
+	Chunks       []Chunk         `json:"Chunks"`
+}
+
+// Splits a file into chunks of chunkSize bytes, last chunk can be smaller
+func MakeChunks(filePath string, chunkSize int64) (chunks []Chunk, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	for {
+		hash := sha256.New()
+		n, err := io.CopyN(hash, f, chunkSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		// empty files still have 1 chunk
+		if n == 0 && len(chunks) > 0 {
+			break
+		}
+		sizeKB := int((n + 1023) / 1024) // round up
+		if sizeKB == 0 {
+			sizeKB = 1
+		}
+		chunks = append(chunks, Chunk{
+			Checksum: hex.EncodeToString(hash.Sum(nil)),
+			SizeKB:   sizeKB,
+		})
+		if n < chunkSize {
+			break
+		}
+	}
+	return chunks, nil
+}
+
+func (ph *PollingHandler) uploadChunk(referralId int, filePath string, filename string, chunkIndex int) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	section := io.NewSectionReader(f, int64(chunkIndex)*ph.chunkSize, ph.chunkSize)
+	resp, code, err := ph.client.MakePostBinary(
+		fmt.Sprintf(ph.serverURL+"/%d/upload/file/%s/%d", referralId, filename, chunkIndex),
+		section)
+	if err != nil {
+		return err
+	}
+	if code != 200 {
+		return fmt.Errorf("chunk %s/%d upload error: %d %s", filename, chunkIndex, code, resp)
+	}
+	return nil
+}
+
+type chunkRef struct {
+	filename   string
+	chunkIndex int
+}
+
+// Uploads chunks with at most ph.uploadParallel requests at once
+func (ph *PollingHandler) uploadChunks(referralId int, payloadDir string, refs []chunkRef) (err error) {
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	sem := make(chan struct{}, max(ph.uploadParallel, 1))
+	for _, ref := range refs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ref chunkRef) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			uploadErr := ph.uploadChunk(referralId, path.Join(payloadDir, ref.filename), ref.filename, ref.chunkIndex)
+			if uploadErr != nil {
+				errMu.Lock()
+				err = uploadErr
+				errMu.Unlock()
+			}
+		}(ref)
+	}
+	wg.Wait()
+	return err
+}
+
+func (ph *PollingHandler) UploadStatus(referralId int) ([]UploadTracking, error) {
+	_, files, err := ph.uploadStatus(referralId)
+	return files, err
+}
+
+// Files the server tracks and the referral status it holds them in
+func (ph *PollingHandler) uploadStatus(referralId int) (db.ReferralStatus, []UploadTracking, error) {
+	response := struct {
+		ReferralStatus db.ReferralStatus `json:"ReferralStatus"`
+		Files          []UploadTracking  `json:"Files"`
+	}{}
+	err := ph.requestDecode(fmt.Sprintf("/%d/upload/status", referralId), 200, &response)
+	if err != nil {
+		return "", []UploadTracking{}, err
+	}
+	return response.ReferralStatus, response.Files, nil
+}
+
+func sameChunks(a []Chunk, b []Chunk) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Checksum != b[i].Checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// Uploads chunks the server does not have yet, files that are not tracked are begun first
+func (ph *PollingHandler) uploadPayload(referralId int, payloadDir string) (err error) {
+	statusList, err := ph.UploadStatus(referralId)
+	if err != nil {
+		return fmt.Errorf("could not get upload status: %s", err)
+	}
+	statusMap := make(map[string]UploadTracking)
+	for _, status := range statusList {
+		statusMap[status.Name] = status
+	}
+	request := struct {
+		ChunkFiles []ChunkFile `json:"ChunkFiles"`
+	}{}
+	missing := []chunkRef{}
+	fileListing, err := os.ReadDir(payloadDir)
+	if err != nil {
+		return
+	}
+	for _, file := range fileListing {
+		status, exists := statusMap[file.Name()]
+		if !exists {
+			return fmt.Errorf("file '%s' is not in referral", file.Name())
+		}
+		if status.UploadStatus == db.CompleteUpload {
+			continue
+		}
+		chunks, err := MakeChunks(path.Join(payloadDir, file.Name()), ph.chunkSize)
+		if err != nil {
+			return err
+		}
+		if len(status.Chunks) == 0 {
+			// not tracked by server
+			request.ChunkFiles = append(request.ChunkFiles, ChunkFile{
+				Name:   file.Name(),
+				Chunks: chunks,
+			})
+			for i := range chunks {
+				missing = append(missing, chunkRef{filename: file.Name(), chunkIndex: i})
+			}
+			continue
+		}
+		if !sameChunks(chunks, status.Chunks) {
+			return fmt.Errorf("file '%s' does not match chunks tracked by server", file.Name())
+		}
+		for i, chunk := range status.Chunks {
+			if chunk.Status != Complete {
+				missing = append(missing, chunkRef{filename: file.Name(), chunkIndex: i})
+			}
+		}
+	}
+	// chunk begin
+	if len(request.ChunkFiles) > 0 {
+		chunkJson, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		resp, code, err := ph.client.MakeJsonRequest(
+			fmt.Sprintf(ph.serverURL+"/%d/upload/begin", referralId),
+			string(chunkJson))
+		if err != nil {
+			return fmt.Errorf("chunk begin error: %s", err)
+		}
+		if code != 201 {
+			return fmt.Errorf("could not chunk begin files: %d %s", code, resp)
+		}
+	}
+	// chunk upload
+	err = ph.uploadChunks(referralId, payloadDir, missing)
+	if err != nil {
+		return
+	}
+	// complete
+	resp, code, err := ph.client.MakeJsonRequest(fmt.Sprintf(ph.serverURL+"/%d/upload/complete", referralId), "")
+	if err != nil {
+		return fmt.Errorf("chunk completion error: %s", err)
+	}
+	if code != 200 {
+		return fmt.Errorf("chunk completion error: %d %s", code, resp)
+	}
+	return nil
+}
+
+// Tells the server to discard the upload, local payload is removed so it is encrypted again
+func (ph *PollingHandler) abortUpload(referralId int, payloadDir string) error {
+	resp, code, err := ph.client.MakeJsonRequest(fmt.Sprintf(ph.serverURL+"/%d/upload/error", referralId), "")
+	if err != nil {
+		return err
+	}
+	if code != 200 {
+		return fmt.Errorf("could not abort upload: %d %s", code, resp)
+	}
+	return os.RemoveAll(payloadDir)
+}
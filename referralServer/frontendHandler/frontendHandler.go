@@ -15,6 +15,7 @@ import (
 
 	"simplemts/lib"
 	db "simplemts/lib/database"
+	statemachine "simplemts/lib/stateMachine"
 
 	"github.com/gorilla/mux"
 )
@@ -61,6 +62,8 @@ func (frontend FrontendServer) RegisterRoutes(database *db.Database) {
 	frontend.router.HandleFunc("/hospitals", handler.GetHospitals).Methods("GET")
 	frontend.router.HandleFunc("/hospital", handler.CreateHospital).Methods("POST")
 	frontend.router.HandleFunc("/referral/{referralId}/consent", handler.GiveConsent).Methods("POST")
+	frontend.router.HandleFunc("/referral/{referralId}/receipt", handler.GetReceipt).Methods("GET")
+	frontend.router.HandleFunc("/referral/{referralId}/history", handler.GetHistory).Methods("GET")
 }
 
 func (rh *RouteHander) ListReferral(w http.ResponseWriter, r *http.Request) {
@@ -127,13 +130,102 @@ func (rh *RouteHander) GiveConsent(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, "Not allowed to give consent")
 		return
 	}
-	ok = rh.Database.UpdateStatusReferralById(referralId, db.Consented)
+	err = statemachine.Apply(rh.Database, referral, statemachine.Trigger{
+		Actor:   statemachine.Patient,
+		ActorId: username,
+	}, db.Consented)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not give consent: %s", err))
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// Delivery receipt of a patient's referral, Verified is checked against the destination's certificate
+func (rh *RouteHander) GetReceipt(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	patient, ok := rh.Database.GetPatientByUsername(username)
 	if !ok {
-		lib.ErrorMessageHandler(w, r, 400, "Could not give consent")
+		lib.ErrorMessageHandler(w, r, 400, "Could not find patient")
+		return
+	}
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
 		return
 	}
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	if referral.CitizenId != patient.CitizenId {
+		lib.ErrorMessageHandler(w, r, 400, "Not allowed to view receipt")
+		return
+	}
+	if referral.Receipt == "" {
+		lib.ErrorMessageHandler(w, r, 404, "Referral has no receipt")
+		return
+	}
+	response := struct {
+		Receipt          lib.Receipt
+		ReceiptSignature string
+		Certificate      string
+		Verified         bool
+	}{
+		ReceiptSignature: referral.ReceiptSignature,
+		Certificate:      referral.ReceiptCertificate,
+	}
+	cert, err := lib.ParseCertificatePEM(referral.ReceiptCertificate)
+	if err == nil {
+		response.Receipt, err = lib.VerifyReceipt(cert, referral.Receipt, referral.ReceiptSignature)
+		response.Verified = err == nil && response.Receipt.ReferralId == referralId &&
+			response.Receipt.Destination == referral.Destination
+	}
+	receiptJson, err := json.Marshal(response)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode receipt")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprint(w, string(receiptJson))
+}
 
+// Status changes of a patient's referral, oldest first
+func (rh *RouteHander) GetHistory(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	patient, ok := rh.Database.GetPatientByUsername(username)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Could not find patient")
+		return
+	}
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	if referral.CitizenId != patient.CitizenId {
+		lib.ErrorMessageHandler(w, r, 400, "Not allowed to view history")
+		return
+	}
+	events, ok := rh.Database.GetEventsByReferral(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 500, "Could not get history")
+		return
+	}
+	eventsJson, err := json.Marshal(events)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode history")
+		return
+	}
 	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"events":%s}`, string(eventsJson))
 }
 
 func (rh *RouteHander) GetHospitals(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,36 @@
+package jobs
+
+import "time"
+
+// Work the central server runs on its own at a fixed interval
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(now time.Time)
+}
+
+type Scheduler struct {
+	jobs []Job
+}
+
+func (s *Scheduler) Add(job Job) {
+	s.jobs = append(s.jobs, job)
+}
+
+// Runs every job in its own goroutine until stop is closed
+func (s *Scheduler) Start(stop <-chan struct{}) {
+	for _, job := range s.jobs {
+		go func(job Job) {
+			ticker := time.NewTicker(job.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case now := <-ticker.C:
+					job.Run(now)
+				}
+			}
+		}(job)
+	}
+}
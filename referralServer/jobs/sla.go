@@ -0,0 +1,108 @@
+package jobs
+
+import (
+	"fmt"
+	"log"
+	"simplemts/lib"
+	db "simplemts/lib/database"
+	statemachine "simplemts/lib/stateMachine"
+	"time"
+)
+
+// How long a referral may stay in a status before it is overdue and before it expires,
+// both counted from when it entered the status. Expire 0 never expires
+type Threshold struct {
+	Escalate time.Duration
+	Expire   time.Duration
+}
+
+// Who a referral waits on in the statuses the monitor watches
+var waitingOn = map[db.ReferralStatus]statemachine.Actor{
+	db.Created:   statemachine.Patient,
+	db.Consented: statemachine.Destination,
+	db.Granted:   statemachine.Origin,
+}
+
+func minutes(key string, defaultVal int) time.Duration {
+	return time.Duration(lib.GetEnvAsInt(key, defaultVal)) * time.Minute
+}
+
+func Thresholds() map[db.ReferralStatus]Threshold {
+	return map[db.ReferralStatus]Threshold{
+		db.Created:   {minutes("SLA_CREATED_MIN", 3*24*60), minutes("EXPIRE_CREATED_MIN", 0)},
+		db.Consented: {minutes("SLA_CONSENTED_MIN", 24*60), minutes("EXPIRE_CONSENTED_MIN", 0)},
+		db.Granted:   {minutes("SLA_GRANTED_MIN", 24*60), minutes("EXPIRE_GRANTED_MIN", 0)},
+	}
+}
+
+type Overdue struct {
+	Referral db.Referral
+	Since    int64 // unix time it entered its status
+	DueBy    int64
+	Waiting  statemachine.Actor
+}
+
+// Referrals stuck in a watched status past its threshold
+func FindOverdue(database *db.Database, now time.Time) (overdue []Overdue) {
+	thresholds := Thresholds()
+	statuses := []db.ReferralStatus{}
+	for status := range waitingOn {
+		statuses = append(statuses, status)
+	}
+	for _, referral := range database.GetReferralsByStatus(statuses) {
+		since := database.GetStatusSince(referral)
+		dueBy := time.Unix(since, 0).Add(thresholds[referral.ReferralStatus].Escalate)
+		if now.Before(dueBy) {
+			continue
+		}
+		overdue = append(overdue, Overdue{
+			Referral: referral,
+			Since:    since,
+			DueBy:    dueBy.Unix(),
+			Waiting:  waitingOn[referral.ReferralStatus],
+		})
+	}
+	return overdue
+}
+
+// Raises one escalation event per overdue status and expires referrals past their expiry
+func CheckSLA(database *db.Database, now time.Time) {
+	thresholds := Thresholds()
+	for _, overdue := range FindOverdue(database, now) {
+		referral := overdue.Referral
+		status := referral.ReferralStatus
+		expire := thresholds[status].Expire
+		if expire > 0 && !now.Before(time.Unix(overdue.Since, 0).Add(expire)) {
+			err := statemachine.Apply(database, referral, statemachine.Trigger{
+				Actor:   statemachine.System,
+				ActorId: "sla",
+				Details: fmt.Sprintf("No action from %s in %s for %s", overdue.Waiting, status, expire),
+			}, db.Expired)
+			if err != nil {
+				log.Printf("Could not expire referral %d: %s", referral.Id, err)
+			}
+			continue
+		}
+		if referral.Escalated == status {
+			continue
+		}
+		database.EscalateReferral(db.ReferralEvent{
+			Referral:   referral.Id,
+			FromStatus: status,
+			ToStatus:   status,
+			Actor:      string(statemachine.System),
+			ActorId:    "sla",
+			Details:    fmt.Sprintf("Overdue, waiting on %s since %s", overdue.Waiting, time.Unix(overdue.Since, 0).Format(time.RFC3339)),
+		})
+	}
+}
+
+func SLAMonitor(database *db.Database) Job {
+	return Job{
+		Name:     "sla",
+		Interval: minutes("SLA_CHECK_MIN", 5),
+		Run: func(now time.Time) {
+			CheckSLA(database, now)
+		},
+	}
+}
@@ -0,0 +1,124 @@
+package jobs_test
+
+import (
+	db "simplemts/lib/database"
+	statemachine "simplemts/lib/stateMachine"
+	"simplemts/referralServer/jobs"
+	"testing"
+	"time"
+)
+
+var database = db.NewDatabase("../../testing_jobs.sqlite")
+
+func createReferral(t *testing.T) db.Referral {
+	id, ok := database.CreateReferralServer(db.Referral{
+		ReferralObject: db.ReferralObject{Origin: "12345", Destination: "67890", Department: "d", Reason: "r"},
+	})
+	if !ok {
+		t.Fatal("Could not create referral")
+	}
+	referral, _ := database.GetReferralById(id)
+	return referral
+}
+
+func findOverdue(referralId int, now time.Time) (jobs.Overdue, bool) {
+	for _, overdue := range jobs.FindOverdue(&database, now) {
+		if overdue.Referral.Id == referralId {
+			return overdue, true
+		}
+	}
+	return jobs.Overdue{}, false
+}
+
+func countEvents(referralId int, actor statemachine.Actor, to db.ReferralStatus) (count int) {
+	events, _ := database.GetEventsByReferral(referralId)
+	for _, event := range events {
+		if event.Actor == string(actor) && event.ToStatus == to {
+			count++
+		}
+	}
+	return count
+}
+
+func TestFindOverdue(t *testing.T) {
+	t.Setenv("SLA_CREATED_MIN", "60")
+	t.Setenv("SLA_CONSENTED_MIN", "120")
+	referral := createReferral(t)
+	now := time.Now()
+	t.Run("Within threshold", func(t *testing.T) {
+		if _, ok := findOverdue(referral.Id, now); ok {
+			t.Errorf("Want not overdue")
+		}
+	})
+	t.Run("Past threshold", func(t *testing.T) {
+		overdue, ok := findOverdue(referral.Id, now.Add(61*time.Minute))
+		if !ok {
+			t.Fatalf("Want overdue")
+		}
+		if overdue.Waiting != statemachine.Patient {
+			t.Errorf("Want waiting on %s, Got %s", statemachine.Patient, overdue.Waiting)
+		}
+	})
+	t.Run("Counted from the current status", func(t *testing.T) {
+		database.TransitionReferral(referral.Id, db.Created, db.Consented)
+		if _, ok := findOverdue(referral.Id, now.Add(61*time.Minute)); ok {
+			t.Errorf("Want not overdue")
+		}
+		overdue, ok := findOverdue(referral.Id, now.Add(121*time.Minute))
+		if !ok || overdue.Waiting != statemachine.Destination {
+			t.Errorf("Want overdue waiting on %s, Got %v %s", statemachine.Destination, ok, overdue.Waiting)
+		}
+	})
+}
+
+func TestCheckSLA(t *testing.T) {
+	t.Setenv("SLA_CREATED_MIN", "60")
+	t.Setenv("EXPIRE_CREATED_MIN", "180")
+	referral := createReferral(t)
+	now := time.Now()
+	t.Run("Escalated once", func(t *testing.T) {
+		jobs.CheckSLA(&database, now.Add(61*time.Minute))
+		jobs.CheckSLA(&database, now.Add(62*time.Minute))
+		if count := countEvents(referral.Id, statemachine.System, db.Created); count != 1 {
+			t.Errorf("Want 1 escalation, Got %d", count)
+		}
+		got, _ := database.GetReferralById(referral.Id)
+		if got.ReferralStatus != db.Created {
+			t.Errorf("Want %s, Got %s", db.Created, got.ReferralStatus)
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		jobs.CheckSLA(&database, now.Add(181*time.Minute))
+		got, _ := database.GetReferralById(referral.Id)
+		if got.ReferralStatus != db.Expired {
+			t.Errorf("Want %s, Got %s", db.Expired, got.ReferralStatus)
+		}
+		if count := countEvents(referral.Id, statemachine.System, db.Expired); count != 1 {
+			t.Errorf("Want 1 expiry event, Got %d", count)
+		}
+		if _, ok := findOverdue(referral.Id, now.Add(181*time.Minute)); ok {
+			t.Errorf("Want expired referral not overdue")
+		}
+	})
+	t.Run("Escalated again after forwarding", func(t *testing.T) {
+		t.Setenv("SLA_CONSENTED_MIN", "120")
+		referral := createReferral(t)
+		database.TransitionReferral(referral.Id, db.Created, db.Consented)
+		jobs.CheckSLA(&database, now.Add(121*time.Minute))
+		database.TransitionReferral(referral.Id, db.Consented, db.Forwarded)
+		database.TransitionReferral(referral.Id, db.Forwarded, db.Consented)
+		jobs.CheckSLA(&database, now.Add(122*time.Minute))
+		if count := countEvents(referral.Id, statemachine.System, db.Consented); count != 2 {
+			t.Errorf("Want 2 escalations, Got %d", count)
+		}
+	})
+	t.Run("No expiry configured", func(t *testing.T) {
+		t.Setenv("EXPIRE_CREATED_MIN", "0")
+		referral := createReferral(t)
+		jobs.CheckSLA(&database, now.Add(24*time.Hour))
+		got, _ := database.GetReferralById(referral.Id)
+		if got.ReferralStatus != db.Created || got.Escalated != db.Created {
+			t.Errorf("Want escalated %s, Got %s escalated %s", db.Created, got.ReferralStatus, got.Escalated)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"simplemts/lib"
+	db "simplemts/lib/database"
+	"time"
+)
+
+var errNoWebhook = errors.New("hospital has no webhook")
+
+// Body of a webhook delivery. Retries can reorder deliveries, the event id gives the order
+type WebhookPayload struct {
+	DeliveryId int
+	Event      db.ReferralEvent
+	Referral   struct {
+		Id             int
+		ReferralStatus db.ReferralStatus
+		Origin         string
+		Destination    string
+		Urgency        db.Urgency
+		Deadline       int64
+		CounterTo      int
+	}
+}
+
+// Works through the delivery queue, failed attempts are retried with exponential backoff
+type WebhookSender struct {
+	Database    *db.Database
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration // before the first retry, doubled for every further one
+	MaxBackoff  time.Duration
+}
+
+func NewWebhookSender(database *db.Database, client *http.Client) WebhookSender {
+	return WebhookSender{
+		Database:    database,
+		Client:      client,
+		MaxAttempts: lib.GetEnvAsInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		Backoff:     time.Duration(lib.GetEnvAsInt("WEBHOOK_BACKOFF_S", 30)) * time.Second,
+		MaxBackoff:  time.Duration(lib.GetEnvAsInt("WEBHOOK_MAX_BACKOFF_S", 60*60)) * time.Second,
+	}
+}
+
+// Delay after the given number of failed attempts
+func (ws *WebhookSender) delay(attempts int) time.Duration {
+	delay := ws.Backoff
+	for i := 1; i < attempts && delay < ws.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, ws.MaxBackoff)
+}
+
+// Attempts every due delivery once
+func (ws *WebhookSender) Send(now time.Time) {
+	for _, delivery := range ws.Database.GetDueDeliveries(now.Unix(), 100) {
+		code, err := ws.deliver(delivery, now)
+		delivery.Attempts++
+		delivery.LastAttempt = now.Unix()
+		delivery.LastCode = code
+		delivery.LastError = ""
+		switch {
+		case err == nil:
+			delivery.Status = db.DeliveryDelivered
+		case errors.Is(err, errNoWebhook) || delivery.Attempts >= ws.MaxAttempts:
+			delivery.Status = db.DeliveryFailed
+			delivery.LastError = err.Error()
+		default:
+			delivery.NextAttempt = now.Add(ws.delay(delivery.Attempts)).Unix()
+			delivery.LastError = err.Error()
+		}
+		if !ws.Database.UpdateDelivery(delivery) {
+			fmt.Println("Could not update webhook delivery", delivery.Id)
+		}
+	}
+}
+
+func (ws *WebhookSender) deliver(delivery db.WebhookDelivery, now time.Time) (code int, err error) {
+	hospital, ok := ws.Database.GetHospitalByHospitalId(delivery.HospitalId)
+	if !ok || hospital.WebhookURL == "" {
+		return 0, errNoWebhook
+	}
+	event, ok := ws.Database.GetEventById(delivery.Event)
+	if !ok {
+		return 0, fmt.Errorf("could not find event %d", delivery.Event)
+	}
+	referral, ok := ws.Database.GetReferralById(delivery.Referral)
+	if !ok {
+		return 0, fmt.Errorf("could not find referral %d", delivery.Referral)
+	}
+	payload := WebhookPayload{DeliveryId: delivery.Id, Event: event}
+	payload.Referral.Id = referral.Id
+	payload.Referral.ReferralStatus = referral.ReferralStatus
+	payload.Referral.Origin = referral.Origin
+	payload.Referral.Destination = referral.Destination
+	payload.Referral.Urgency = referral.Urgency
+	payload.Referral.Deadline = referral.Deadline
+	payload.Referral.CounterTo = referral.CounterTo
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	request, err := http.NewRequest(http.MethodPost, hospital.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(lib.WebhookTimestampHeader, fmt.Sprint(now.Unix()))
+	request.Header.Set(lib.WebhookSignatureHeader, lib.SignWebhook(hospital.WebhookSecret, now.Unix(), body))
+	response, err := ws.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+func WebhookJob(sender WebhookSender) Job {
+	return Job{
+		Name:     "webhooks",
+		Interval: time.Duration(lib.GetEnvAsInt("WEBHOOK_CHECK_S", 10)) * time.Second,
+		Run:      sender.Send,
+	}
+}
@@ -0,0 +1,83 @@
+package jobs_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"simplemts/lib"
+	db "simplemts/lib/database"
+	"simplemts/referralServer/jobs"
+	"testing"
+	"time"
+)
+
+func TestWebhookSender(t *testing.T) {
+	const secret = "secret"
+	status := 200
+	received := []jobs.WebhookPayload{}
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		err := lib.VerifyWebhook(secret, r.Header.Get(lib.WebhookTimestampHeader), r.Header.Get(lib.WebhookSignatureHeader), body, time.Hour)
+		if err != nil {
+			t.Errorf("Invalid delivery: %s", err)
+		}
+		payload := jobs.WebhookPayload{}
+		json.Unmarshal(body, &payload)
+		received = append(received, payload)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+	database.UpdateHospitalWebhook("1111", receiver.URL, secret)
+	defer database.UpdateHospitalWebhook("1111", "", "")
+	sender := jobs.NewWebhookSender(&database, receiver.Client())
+	sender.MaxAttempts = 3
+	sender.Backoff = time.Minute
+	sender.MaxBackoff = time.Hour
+
+	referralId, _ := database.CreateReferralServer(db.Referral{
+		ReferralObject: db.ReferralObject{Origin: "1111", Destination: "2222", Department: "d", Reason: "r"},
+	})
+	latest := func() db.WebhookDelivery {
+		deliveries, _ := database.GetDeliveriesByHospital("1111", 1)
+		if len(deliveries) == 0 {
+			t.Fatal("No delivery queued")
+		}
+		return deliveries[0]
+	}
+	now := time.Now()
+	t.Run("Delivered", func(t *testing.T) {
+		database.CreateReferralEvent(db.ReferralEvent{Referral: referralId, ToStatus: db.Created})
+		sender.Send(now)
+		if len(received) != 1 || received[0].Referral.Id != referralId || received[0].Event.ToStatus != db.Created {
+			t.Fatalf("Unexpected deliveries: %v", received)
+		}
+		if delivery := latest(); delivery.Status != db.DeliveryDelivered || delivery.LastCode != 200 {
+			t.Errorf("Want %s 200, Got %s %d", db.DeliveryDelivered, delivery.Status, delivery.LastCode)
+		}
+	})
+	t.Run("Retried with backoff", func(t *testing.T) {
+		status = 500
+		database.TransitionReferralEvent(db.ReferralEvent{Referral: referralId, FromStatus: db.Created, ToStatus: db.Consented})
+		sender.Send(now)
+		delivery := latest()
+		if delivery.Status != db.DeliveryPending || delivery.Attempts != 1 || delivery.NextAttempt != now.Add(time.Minute).Unix() {
+			t.Errorf("Want pending retry in a minute, Got %+v", delivery)
+		}
+		sender.Send(now.Add(30 * time.Second))
+		if got := latest().Attempts; got != 1 {
+			t.Errorf("Want no attempt before the backoff, Got %d attempts", got)
+		}
+		sender.Send(now.Add(time.Minute))
+		if got := latest().NextAttempt; got != now.Add(3*time.Minute).Unix() {
+			t.Errorf("Want next attempt after a doubled backoff, Got %d", got-now.Unix())
+		}
+	})
+	t.Run("Given up", func(t *testing.T) {
+		sender.Send(now.Add(3 * time.Minute))
+		delivery := latest()
+		if delivery.Status != db.DeliveryFailed || delivery.Attempts != 3 || delivery.LastCode != 500 {
+			t.Errorf("Want failed after 3 attempts, Got %+v", delivery)
+		}
+	})
+}
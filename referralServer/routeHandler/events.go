@@ -0,0 +1,83 @@
+package routehandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"simplemts/lib"
+	"time"
+)
+
+// Server-Sent Events stream of the hospital's referral changes after the ?since= cursor.
+// Each event is named incoming or outgoing, carries the referral as /incoming and
+// /outgoing report it and has its change sequence as id
+func (rh *RouteHander) Events(w http.ResponseWriter, r *http.Request) {
+	clientHospitalId := lib.GetContextHospital(r)
+	since, err := sinceCursor(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 500, "Streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "retry: %d\n\n", lib.GetEnvAsInt("EVENTS_RETRY_S", 5)*1000)
+	flusher.Flush()
+
+	// proxies drop idle connections
+	keepalive := time.NewTicker(time.Duration(lib.GetEnvAsInt("EVENTS_KEEPALIVE_S", 15)) * time.Second)
+	defer keepalive.Stop()
+	// a cursor per direction, a change written between the two reads goes out next round
+	incomingSince, outgoingSince := since, since
+	for {
+		changes := rh.Database.Changes()
+		incomingSince, err = rh.sendEvents(w, clientHospitalId, incomingSince, false)
+		if err != nil {
+			return
+		}
+		outgoingSince, err = rh.sendEvents(w, clientHospitalId, outgoingSince, true)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	wait:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-changes:
+				break wait
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func (rh *RouteHander) sendEvents(w http.ResponseWriter, clientHospitalId string, since int64, isOrigin bool) (cursor int64, err error) {
+	event := "incoming"
+	if isOrigin {
+		event = "outgoing"
+	}
+	referrals, cursor := rh.changedReferrals(clientHospitalId, since, isOrigin)
+	for _, referral := range referrals {
+		referralJson, err := json.Marshal(referral)
+		if err != nil {
+			return since, err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", referral.Seq, event, referralJson)
+		if err != nil {
+			return since, err
+		}
+	}
+	return cursor, nil
+}
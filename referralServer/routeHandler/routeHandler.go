@@ -2,13 +2,21 @@ package routehandler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
 	"simplemts/lib"
 	db "simplemts/lib/database"
+	statemachine "simplemts/lib/stateMachine"
+	"simplemts/referralServer/jobs"
 	"simplemts/referralServer/server"
 	uploadhandler "simplemts/referralServer/uploadHandler"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type RouteHander struct {
@@ -32,10 +40,20 @@ func RegisterRoutes(server server.Server, database *db.Database) {
 	server.Router.HandleFunc("/outgoing", func(w http.ResponseWriter, r *http.Request) {
 		handler.Poll(w, r, true)
 	}).Methods("GET")
+	// Referral changes pushed as they happen
+	server.Router.HandleFunc("/events", handler.Events).Methods("GET")
+	// Webhook for hospitals without the polling client
+	server.Router.HandleFunc("/webhook", handler.RegisterWebhook).Methods("POST")
+	server.Router.HandleFunc("/webhook", handler.RemoveWebhook).Methods("DELETE")
+	server.Router.HandleFunc("/webhook/deliveries", handler.GetWebhookDeliveries).Methods("GET")
+	// Referrals stuck past their SLA, for both sides
+	server.Router.HandleFunc("/overdue", handler.GetOverdue).Methods("GET")
 
 	// Frontend
 	server.Router.HandleFunc("/hospitals", handler.GetHospitals).Methods("GET")
+	server.Router.HandleFunc("/hospitals/keys", handler.GetHospitalKeys).Methods("GET")
 	server.Router.HandleFunc("/{referralId}", handler.GetReferral).Methods("GET")
+	server.Router.HandleFunc("/{referralId}/history", handler.GetHistory).Methods("GET")
 
 	// Grant
 	server.Router.HandleFunc("/{referralId}/grant", handler.GrantReferral).Methods("POST")
@@ -44,7 +62,8 @@ func RegisterRoutes(server server.Server, database *db.Database) {
 	server.Router.HandleFunc("/{referralId}/upload/begin", uploadHandler.ChunkBegin).Methods("POST")
 	server.Router.HandleFunc("/{referralId}/upload/file/{filename}/{chunkIndex}", uploadHandler.ChunkUpload).Methods("POST")
 	server.Router.HandleFunc("/{referralId}/upload/complete", uploadHandler.Complete).Methods("POST")
-	// server.Router.HandleFunc("/{referralId}/upload/error", uploadHandler.Error).Methods("GET")
+	server.Router.HandleFunc("/{referralId}/upload/status", uploadHandler.Status).Methods("GET")
+	server.Router.HandleFunc("/{referralId}/upload/error", uploadHandler.Error).Methods("POST")
 	// Download
 	server.Router.HandleFunc("/{referralId}/download", uploadHandler.GetFiles).Methods("GET")
 
@@ -55,6 +74,15 @@ func RegisterRoutes(server server.Server, database *db.Database) {
 
 	// Referral complete
 	server.Router.HandleFunc("/{referralId}/complete", handler.Complete).Methods("POST")
+	server.Router.HandleFunc("/{referralId}/receipt", handler.GetReceipt).Methods("GET")
+	server.Router.HandleFunc("/{referralId}/reject", handler.Reject).Methods("POST")
+	// Destination sends the referral on to another hospital
+	server.Router.HandleFunc("/{referralId}/forward", handler.ForwardReferral).Methods("POST")
+	// Counter-referral, results back to the origin
+	server.Router.HandleFunc("/{referralId}/counter", handler.CreateCounterReferral).Methods("POST")
+	server.Router.HandleFunc("/{referralId}/counter", handler.GetCounterReferrals).Methods("GET")
+	// Withdrawn by the origin
+	server.Router.HandleFunc("/{referralId}/cancel", uploadHandler.Cancel).Methods("POST")
 }
 
 func (rh *RouteHander) AuthenticationMiddleware(next http.Handler) http.Handler {
@@ -70,6 +98,11 @@ func (rh *RouteHander) AuthenticationMiddleware(next http.Handler) http.Handler
 			lib.ErrorMessageHandler(w, r, 400, "Unknown hospital")
 			return
 		}
+		// Keep certificate for the key directory
+		certificate := lib.EncodeCertificatePEM(certs[0])
+		if hospital.Certificate != certificate {
+			rh.Database.UpdateHospitalCertificate(hospital.Id, certificate)
+		}
 		rWithHospital := lib.AddHospitalContext(r, hospital.HospitalId)
 		next.ServeHTTP(w, rWithHospital)
 	})
@@ -95,6 +128,27 @@ func validateSyntaxPatient(response *db.PatientObject) error {
 	return nil
 }
 
+func validateUrgency(urgency db.Urgency) error {
+	switch urgency {
+	case db.Emergency, db.Urgent, db.Routine:
+		return nil
+	default:
+		return fmt.Errorf("urgency should be %s, %s or %s", db.Emergency, db.Urgent, db.Routine)
+	}
+}
+
+func validateDecline(code db.DeclineCode) error {
+	switch code {
+	case db.NoCapacity, db.WrongDepartment, db.NeedsInformation, db.OtherDecline:
+		return nil
+	case "":
+		return fmt.Errorf("decline code is required when not granting")
+	default:
+		return fmt.Errorf("decline code should be %s, %s, %s or %s",
+			db.NoCapacity, db.WrongDepartment, db.NeedsInformation, db.OtherDecline)
+	}
+}
+
 func (rh *RouteHander) CreateReferral(w http.ResponseWriter, r *http.Request) {
 	// Needs to check empty, else empty dest
 	clientHospitalId := lib.GetContextHospital(r)
@@ -106,6 +160,10 @@ func (rh *RouteHander) CreateReferral(w http.ResponseWriter, r *http.Request) {
 		// Referral
 		db.ReferralObject
 		db.PatientObject
+		// Broadcast, every candidate can claim the referral; Destination is one of them
+		Candidates []string   `json:"Candidates" validate:"omitempty,unique,dive,required"`
+		Ranked     bool       `json:"Ranked"`
+		Urgency    db.Urgency `json:"Urgency"`
 	}{}
 	// Syntax Check
 	err := lib.DecodeValidate(&response, r.Body)
@@ -118,6 +176,14 @@ func (rh *RouteHander) CreateReferral(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, err.Error())
 		return
 	}
+	if response.Urgency == "" {
+		response.Urgency = db.Routine
+	}
+	err = validateUrgency(response.Urgency)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
 	// Semantic Check
 	if clientHospitalId != response.Origin {
 		lib.ErrorMessageHandler(w, r, 400, "Origin needs to be client")
@@ -127,45 +193,109 @@ func (rh *RouteHander) CreateReferral(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, "Destination cannot be origin")
 		return
 	}
+	if len(response.Candidates) > 0 && !slices.Contains(response.Candidates, response.Destination) {
+		lib.ErrorMessageHandler(w, r, 400, "Destination needs to be one of the candidates")
+		return
+	}
+	if slices.Contains(response.Candidates, response.Origin) {
+		lib.ErrorMessageHandler(w, r, 400, "Candidate cannot be origin")
+		return
+	}
 	// TODO Check certificate match origin
 	// TODO Check Origin/Destination Hospital Exists
 	// Work
 	referral := db.Referral{
 		ReferralObject: response.ReferralObject,
 		PatientObject:  response.PatientObject,
+		Urgency:        response.Urgency,
+		Deadline:       lib.ResponseDeadline(response.Urgency, time.Now()),
 	}
 	id, ok := rh.Database.CreateReferralServer(referral)
 	if !ok {
 		lib.ErrorMessageHandler(w, r, 400, "Could not create referral")
 		return
 	}
+	if len(response.Candidates) > 0 {
+		candidates := []db.ReferralCandidate{}
+		for i, hospitalId := range response.Candidates {
+			candidate := db.ReferralCandidate{
+				Referral:   id,
+				HospitalId: hospitalId,
+				Status:     db.CandidatePending,
+			}
+			if response.Ranked {
+				candidate.Rank = i + 1
+			}
+			candidates = append(candidates, candidate)
+		}
+		if !rh.Database.CreateReferralCandidates(candidates) {
+			lib.ErrorMessageHandler(w, r, 500, "Could not store candidates")
+			return
+		}
+	}
+	rh.Database.CreateReferralEvent(db.ReferralEvent{
+		Referral: id,
+		ToStatus: db.Created,
+		Actor:    string(statemachine.Origin),
+		ActorId:  clientHospitalId,
+	})
 	w.WriteHeader(201)
 	fmt.Fprintf(w, `{"id":%d}`, id)
 }
 
-func (rh *RouteHander) Poll(w http.ResponseWriter, r *http.Request, isOrigin bool) {
-	clientHospitalId := lib.GetContextHospital(r)
+// Referral as /incoming, /outgoing and /events report it
+type polledReferral = struct {
+	Id             int               `json:"Id" validate:"required"`
+	ReferralStatus db.ReferralStatus `json:"ReferralStatus" validate:"required"`
+	db.PatientObject
+	Destination   string
+	Origin        string
+	Reason        string
+	Created       int64
+	DeclineCode   db.DeclineCode
+	DeclineReason string
+	CounterTo     int
+	Urgency       db.Urgency
+	Deadline      int64
+	// Set for a broadcast referral, where the client stands as a candidate
+	CandidateStatus db.CandidateStatus `json:",omitempty"`
+	Rank            int                `json:",omitempty"`
+	Seq             int64
+}
+
+func sinceCursor(r *http.Request) (since int64, err error) {
+	sinceStr := r.URL.Query().Get("since")
+	if sinceStr == "" {
+		return 0, nil
+	}
+	since, err = strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil || since < 0 {
+		return 0, fmt.Errorf("Invalid since cursor")
+	}
+	return since, nil
+}
+
+// Hospital's referrals changed after since in change order, and the cursor past them
+func (rh *RouteHander) changedReferrals(clientHospitalId string, since int64, isOrigin bool) (referralList []polledReferral, cursor int64) {
 	var referrals []db.Referral
 	if isOrigin {
-		referrals = rh.Database.GetReferralsByOrigin(clientHospitalId)
+		referrals = rh.Database.GetReferralsByOrigin(clientHospitalId, since)
 	} else {
-		referrals = rh.Database.GetReferralsByDestination(clientHospitalId)
-	}
-
-	type referral = struct {
-		Id             int               `json:"Id" validate:"required"`
-		ReferralStatus db.ReferralStatus `json:"ReferralStatus" validate:"required"`
-		db.PatientObject
-		Destination string
-		Origin      string
-		Reason      string
-		Created     int64
+		referrals = rh.Database.GetReferralsByDestination(clientHospitalId, since)
+		// broadcast referrals, also after another candidate claimed them
+		for _, val := range rh.Database.GetReferralsByCandidate(clientHospitalId, since) {
+			if val.Destination != clientHospitalId {
+				referrals = append(referrals, val)
+			}
+		}
+		sort.SliceStable(referrals, func(i, j int) bool {
+			return referrals[i].Seq < referrals[j].Seq
+		})
 	}
-	// Work
-	var referralList []referral
-
+	cursor = since
 	for _, val := range referrals {
-		referralList = append(referralList, referral{
+		cursor = max(cursor, val.Seq)
+		referralList = append(referralList, polledReferral{
 			Id:             val.Id,
 			ReferralStatus: val.ReferralStatus,
 			PatientObject:  val.PatientObject,
@@ -173,11 +303,48 @@ func (rh *RouteHander) Poll(w http.ResponseWriter, r *http.Request, isOrigin boo
 			Origin:         val.Origin,
 			Destination:    val.Destination,
 			Reason:         val.Reason,
+			DeclineCode:    val.DeclineCode,
+			DeclineReason:  val.DeclineReason,
+			CounterTo:      val.CounterTo,
+			Urgency:        val.Urgency,
+			Deadline:       val.Deadline,
+			Seq:            val.Seq,
+		})
+		if isOrigin {
+			continue
+		}
+		if candidate, ok := rh.Database.GetCandidate(val.Id, clientHospitalId); ok {
+			referralList[len(referralList)-1].CandidateStatus = candidate.Status
+			referralList[len(referralList)-1].Rank = candidate.Rank
+		}
+	}
+	return referralList, cursor
+}
+
+// Referrals changed after the ?since= cursor, all of them without one.
+// The cursor to send next time comes back with them
+func (rh *RouteHander) Poll(w http.ResponseWriter, r *http.Request, isOrigin bool) {
+	clientHospitalId := lib.GetContextHospital(r)
+	since, err := sinceCursor(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	// Work
+	referralList, cursor := rh.changedReferrals(clientHospitalId, since, isOrigin)
+	// most urgent first, then the closest deadline
+	if !isOrigin {
+		sort.SliceStable(referralList, func(i, j int) bool {
+			a, b := referralList[i], referralList[j]
+			if a.Urgency.Priority() != b.Urgency.Priority() {
+				return a.Urgency.Priority() < b.Urgency.Priority()
+			}
+			return a.Deadline < b.Deadline
 		})
 	}
-	w.WriteHeader(200)
 	if referralList == nil {
-		fmt.Fprintf(w, `{"referrals":[]}`)
+		w.WriteHeader(200)
+		fmt.Fprintf(w, `{"referrals":[],"cursor":%d}`, cursor)
 		return
 	}
 
@@ -186,7 +353,272 @@ func (rh *RouteHander) Poll(w http.ResponseWriter, r *http.Request, isOrigin boo
 		lib.ErrorMessageHandler(w, r, 400, "Could not create referral")
 		return
 	}
-	fmt.Fprintf(w, `{"referrals":%s}`, string(referralJson))
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"referrals":%s,"cursor":%d}`, string(referralJson), cursor)
+}
+
+// First candidate to grant becomes the destination, the referral is declined once every candidate declined
+func (rh *RouteHander) answerCandidate(w http.ResponseWriter, r *http.Request, referral db.Referral,
+	candidate db.ReferralCandidate, granted bool, declineCode db.DeclineCode, declineReason string) {
+	if candidate.Status != db.CandidatePending {
+		lib.ErrorMessageHandler(w, r, http.StatusConflict, fmt.Sprintf("Referral is no longer available: %s", candidate.Status))
+		return
+	}
+	// claimed or cancelled, candidates may not be closed yet
+	if referral.ReferralStatus != db.Created && referral.ReferralStatus != db.Consented {
+		lib.ErrorMessageHandler(w, r, http.StatusConflict, fmt.Sprintf("Referral is no longer available: %s", referral.ReferralStatus))
+		return
+	}
+	trigger := statemachine.Trigger{
+		Actor:   statemachine.Destination,
+		ActorId: candidate.HospitalId,
+	}
+	if granted {
+		// status, destination and candidates change together, concurrent grants get a conflict
+		trigger.Updates = map[string]interface{}{"destination": candidate.HospitalId}
+		trigger.Effects = []statemachine.Effect{func(database *db.Database, referralId int) error {
+			if !database.CloseCandidates(referralId, candidate.HospitalId) {
+				return fmt.Errorf("could not close candidates")
+			}
+			return nil
+		}}
+		err := statemachine.Apply(rh.Database, referral, trigger, db.Granted)
+		if err != nil {
+			lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not grant: %s", err))
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+	if _, err := statemachine.Find(referral.ReferralStatus, db.NotGranted, statemachine.Destination); err != nil {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not decline: %s", err))
+		return
+	}
+	if !rh.Database.DeclineCandidate(referral.Id, candidate.HospitalId, declineCode, declineReason) {
+		lib.ErrorMessageHandler(w, r, http.StatusConflict, "Referral is no longer available")
+		return
+	}
+	candidates, ok := rh.Database.GetCandidatesByReferral(referral.Id)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 500, "Could not get candidates")
+		return
+	}
+	for _, other := range candidates {
+		if other.Status != db.CandidateDeclined {
+			w.WriteHeader(200)
+			return
+		}
+	}
+	trigger.Details = fmt.Sprintf("%s: %s", declineCode, declineReason)
+	trigger.Updates = map[string]interface{}{"decline_code": declineCode, "decline_reason": declineReason}
+	err := statemachine.Apply(rh.Database, referral, trigger, db.NotGranted)
+	// a concurrent last decline already set the status
+	if err != nil && !errors.Is(err, statemachine.ErrConflict) {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not decline: %s", err))
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// Destination passes the referral on, the patient has to consent to the new destination.
+// A received payload is kept, the destination wraps its key again for the new destination
+func (rh *RouteHander) ForwardReferral(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	response := struct {
+		Destination string `json:"Destination" validate:"required"`
+		Reason      string `json:"Reason" validate:"required"`
+		PayloadKey  string `json:"PayloadKey"`
+	}{}
+	// Syntax Check
+	err = lib.DecodeValidate(&response, r.Body)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	// Semantic Check
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	actor, ok := statemachine.HospitalActor(referral, clientHospitalId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to forward referral")
+		return
+	}
+	if candidate, ok := rh.Database.GetCandidate(referralId, clientHospitalId); ok && candidate.Status != db.CandidateClaimed {
+		lib.ErrorMessageHandler(w, r, 400, "Could not forward: referral was not claimed yet")
+		return
+	}
+	if _, err = statemachine.Find(referral.ReferralStatus, db.Forwarded, actor); err != nil {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not forward: %s", err))
+		return
+	}
+	if _, ok := rh.Database.GetHospitalByHospitalId(response.Destination); !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Could not find destination hospital")
+		return
+	}
+	forwards, ok := rh.Database.GetForwardsByReferral(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 500, "Could not get forwarding chain")
+		return
+	}
+	visited := map[string]bool{referral.Origin: true, referral.Destination: true}
+	for _, forward := range forwards {
+		visited[forward.FromHospital] = true
+	}
+	if visited[response.Destination] {
+		lib.ErrorMessageHandler(w, r, 400, "Referral was already at the destination hospital")
+		return
+	}
+	payloadKey := ""
+	if referral.PayloadKey != "" {
+		if !strings.HasPrefix(response.PayloadKey, lib.WrappedKeyPrefix) {
+			lib.ErrorMessageHandler(w, r, 400, "Payload key needs to be wrapped for the new destination")
+			return
+		}
+		payloadKey = response.PayloadKey
+	}
+	// Work
+	forward := db.ReferralForward{
+		Referral:           referralId,
+		FromHospital:       referral.Destination,
+		ToHospital:         response.Destination,
+		Reason:             response.Reason,
+		Receipt:            referral.Receipt,
+		ReceiptSignature:   referral.ReceiptSignature,
+		ReceiptCertificate: referral.ReceiptCertificate,
+	}
+	err = statemachine.Apply(rh.Database, referral, statemachine.Trigger{
+		Actor:   actor,
+		ActorId: clientHospitalId,
+		Details: fmt.Sprintf("Forwarded to %s: %s", response.Destination, response.Reason),
+		Updates: map[string]interface{}{
+			"destination":         response.Destination,
+			"payload_key":         payloadKey,
+			"receipt":             "",
+			"receipt_signature":   "",
+			"receipt_certificate": "",
+		},
+		Effects: []statemachine.Effect{func(database *db.Database, referralId int) error {
+			if !database.CreateReferralForward(forward) {
+				return fmt.Errorf("could not record forward")
+			}
+			return nil
+		}},
+	}, db.Forwarded)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not forward: %s", err))
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// Destination sends results of a completed referral back to the origin,
+// the counter-referral is a referral in the opposite direction
+func (rh *RouteHander) CreateCounterReferral(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	response := struct {
+		Reason string `json:"Reason" validate:"required"`
+	}{}
+	// Syntax Check
+	err = lib.DecodeValidate(&response, r.Body)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	// Semantic Check
+	original, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	if original.Destination != clientHospitalId {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: only the destination can send results back")
+		return
+	}
+	if original.ReferralStatus != db.Complete {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not send results back: referral is in state %s", original.ReferralStatus))
+		return
+	}
+	// Work
+	referral := db.Referral{
+		ReferralObject: db.ReferralObject{
+			Origin:      original.Destination,
+			Destination: original.Origin,
+			Department:  original.Department,
+			Reason:      response.Reason,
+		},
+		PatientObject: original.PatientObject,
+		CounterTo:     original.Id,
+	}
+	id, ok := rh.Database.CreateCounterReferral(referral)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Could not create counter-referral")
+		return
+	}
+	rh.Database.CreateReferralEvent(db.ReferralEvent{
+		Referral: id,
+		ToStatus: db.CounterCreated,
+		Actor:    string(statemachine.Origin),
+		ActorId:  clientHospitalId,
+		Details:  fmt.Sprintf("Counter-referral to %d", original.Id),
+	})
+	w.WriteHeader(201)
+	fmt.Fprintf(w, `{"id":%d}`, id)
+}
+
+// Counter-referrals sent back for a referral
+func (rh *RouteHander) GetCounterReferrals(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	// Semantic
+	original, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	if original.Destination != clientHospitalId && original.Origin != clientHospitalId {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to view referral")
+		return
+	}
+	// Work
+	type counterReferral = struct {
+		Id             int
+		ReferralStatus db.ReferralStatus
+		Reason         string
+		Created        int64
+	}
+	counterList := []counterReferral{}
+	for _, val := range rh.Database.GetCounterReferrals(referralId) {
+		counterList = append(counterList, counterReferral{
+			Id:             val.Id,
+			ReferralStatus: val.ReferralStatus,
+			Reason:         val.Reason,
+			Created:        val.Created,
+		})
+	}
+	counterJson, err := json.Marshal(counterList)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode counter-referrals")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"referrals":%s}`, string(counterJson))
 }
 
 func (rh *RouteHander) GrantReferral(w http.ResponseWriter, r *http.Request) {
@@ -197,7 +629,9 @@ func (rh *RouteHander) GrantReferral(w http.ResponseWriter, r *http.Request) {
 	}
 	clientHospitalId := lib.GetContextHospital(r)
 	response := struct {
-		Granted bool `json:"Granted"` // No 'required' because can be true or false https://pkg.go.dev/github.com/go-playground/validator/v10#hdr-Required
+		Granted       bool           `json:"Granted"` // No 'required' because can be true or false https://pkg.go.dev/github.com/go-playground/validator/v10#hdr-Required
+		DeclineCode   db.DeclineCode `json:"DeclineCode"`
+		DeclineReason string         `json:"DeclineReason"`
 	}{}
 	// Syntax Check
 	err = lib.DecodeValidate(&response, r.Body)
@@ -205,30 +639,60 @@ func (rh *RouteHander) GrantReferral(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, err.Error())
 		return
 	}
+	if !response.Granted {
+		err = validateDecline(response.DeclineCode)
+		if err != nil {
+			lib.ErrorMessageHandler(w, r, 400, err.Error())
+			return
+		}
+	}
 	// Semantic Check
 	referral, ok := rh.Database.GetReferralById(referralId)
 	if !ok {
 		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
 		return
 	}
-	if referral.Destination != clientHospitalId {
-		lib.ErrorMessageHandler(w, r, 400, "Destination mismatch: client does not have permission to grant referral")
+	// Broadcast referral nobody claimed yet, every candidate answers for itself
+	if candidate, ok := rh.Database.GetCandidate(referralId, clientHospitalId); ok && candidate.Status != db.CandidateClaimed {
+		rh.answerCandidate(w, r, referral, candidate, response.Granted, response.DeclineCode, response.DeclineReason)
 		return
 	}
-	if referral.ReferralStatus != db.Consented {
-		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not grant: referral is in state %s", referral.ReferralStatus))
+	actor, ok := statemachine.HospitalActor(referral, clientHospitalId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to grant referral")
 		return
 	}
 	// Work
 	var update db.ReferralStatus
+	trigger := statemachine.Trigger{
+		Actor:   actor,
+		ActorId: clientHospitalId,
+	}
 	if response.Granted {
 		update = db.Granted
+		// Forwarded referral, the payload the previous destination received can be downloaded right away
+		if referral.PayloadKey != "" {
+			trigger.Effects = []statemachine.Effect{func(database *db.Database, referralId int) error {
+				granted := referral
+				granted.ReferralStatus = db.Granted
+				return statemachine.Apply(database, granted, statemachine.Trigger{
+					Actor:   actor,
+					ActorId: clientHospitalId,
+					Details: "Forwarded payload",
+				}, db.UploadComplete)
+			}}
+		}
 	} else {
 		update = db.NotGranted
+		trigger.Details = fmt.Sprintf("%s: %s", response.DeclineCode, response.DeclineReason)
+		trigger.Updates = map[string]interface{}{
+			"decline_code":   response.DeclineCode,
+			"decline_reason": response.DeclineReason,
+		}
 	}
-	ok = rh.Database.UpdateStatusReferralById(referralId, update)
-	if !ok {
-		lib.ErrorMessageHandler(w, r, 400, "Could not update referral")
+	err = statemachine.Apply(rh.Database, referral, trigger, update)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not grant: %s", err))
 		return
 	}
 	w.WriteHeader(200)
@@ -241,29 +705,121 @@ func (rh *RouteHander) Complete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	clientHospitalId := lib.GetContextHospital(r)
+	response := struct {
+		Receipt          string `json:"Receipt" validate:"required"`
+		ReceiptSignature string `json:"ReceiptSignature" validate:"required"`
+	}{}
+	// Syntax Check
+	err = lib.DecodeValidate(&response, r.Body)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
 	// Semantic Check
 	referral, ok := rh.Database.GetReferralById(referralId)
 	if !ok {
 		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
 		return
 	}
-	if referral.Destination != clientHospitalId {
-		lib.ErrorMessageHandler(w, r, 400, "Destination mismatch: client does not have permission to grant referral")
+	actor, ok := statemachine.HospitalActor(referral, clientHospitalId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to complete referral")
+		return
+	}
+	if _, err = statemachine.Find(referral.ReferralStatus, statemachine.Flow(referral).Downloaded, actor); err != nil {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not complete: %s", err))
+		return
+	}
+	// Receipt has to be signed by the destination's certificate and list the uploaded files
+	hospital, ok := rh.Database.GetHospitalByHospitalId(clientHospitalId)
+	if !ok || hospital.Certificate == "" {
+		lib.ErrorMessageHandler(w, r, 400, "No certificate recorded for hospital")
+		return
+	}
+	cert, err := lib.ParseCertificatePEM(hospital.Certificate)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, "Could not parse hospital certificate")
 		return
 	}
-	if referral.ReferralStatus != db.UploadComplete {
-		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not grant: referral is in state %s", referral.ReferralStatus))
+	receipt, err := lib.VerifyReceipt(cert, response.Receipt, response.ReceiptSignature)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not verify receipt: %s", err))
 		return
 	}
-	ok = rh.Database.UpdateStatusReferralById(referralId, db.Complete)
+	files, ok := rh.Database.GetFilesByReferral(referralId)
 	if !ok {
-		lib.ErrorMessageHandler(w, r, 400, "Could not update referral")
+		lib.ErrorMessageHandler(w, r, 500, "Could not get files from referralId")
+		return
+	}
+	checksums := make(map[string]string, len(files))
+	for _, file := range files {
+		checksums[file.Name] = file.Checksum
+	}
+	if receipt.ReferralId != referralId || receipt.Destination != referral.Destination || !receipt.Matches(checksums) {
+		lib.ErrorMessageHandler(w, r, 400, "Receipt does not match referral")
+		return
+	}
+	// Work, only the request that completes the referral stores its receipt, with the status
+	err = statemachine.Apply(rh.Database, referral, statemachine.Trigger{
+		Actor:   actor,
+		ActorId: clientHospitalId,
+		Details: fmt.Sprintf("Receipt signed at %s", time.Unix(receipt.Timestamp, 0).UTC().Format(time.RFC3339)),
+		Updates: map[string]interface{}{
+			"receipt":             response.Receipt,
+			"receipt_signature":   response.ReceiptSignature,
+			"receipt_certificate": hospital.Certificate,
+		},
+	}, statemachine.Flow(referral).Downloaded)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not complete: %s", err))
 		return
 	}
 	w.WriteHeader(200)
 }
 
-func (rh *RouteHander) GetReferral(w http.ResponseWriter, r *http.Request) {
+// Signed receipt with the certificate it was checked against, so it can be verified again
+func (rh *RouteHander) GetReceipt(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	// Semantic
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	if referral.Destination != clientHospitalId && referral.Origin != clientHospitalId {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to view receipt")
+		return
+	}
+	if referral.Receipt == "" {
+		lib.ErrorMessageHandler(w, r, 404, "Referral has no receipt")
+		return
+	}
+	// Work
+	receiptJson, err := json.Marshal(struct {
+		Destination      string
+		Receipt          string
+		ReceiptSignature string
+		Certificate      string
+	}{
+		Destination:      referral.Destination,
+		Receipt:          referral.Receipt,
+		ReceiptSignature: referral.ReceiptSignature,
+		Certificate:      referral.ReceiptCertificate,
+	})
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode receipt")
+		return
+	}
+	fmt.Fprint(w, string(receiptJson))
+}
+
+// Status changes of a referral, oldest first
+func (rh *RouteHander) GetHistory(w http.ResponseWriter, r *http.Request) {
 	referralId, err := lib.GetReferralId(r)
 	if err != nil {
 		lib.ErrorMessageHandler(w, r, 400, err.Error())
@@ -277,6 +833,110 @@ func (rh *RouteHander) GetReferral(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if referral.Destination != clientHospitalId && referral.Origin != clientHospitalId {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to view history")
+		return
+	}
+	// Work
+	events, ok := rh.Database.GetEventsByReferral(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 500, "Could not get history")
+		return
+	}
+	eventsJson, err := json.Marshal(events)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode history")
+		return
+	}
+	fmt.Fprintf(w, `{"events":%s}`, string(eventsJson))
+}
+
+func (rh *RouteHander) GetOverdue(w http.ResponseWriter, r *http.Request) {
+	clientHospitalId := lib.GetContextHospital(r)
+	type overdueReferral = struct {
+		Id             int
+		ReferralStatus db.ReferralStatus
+		Origin         string
+		Destination    string
+		Urgency        db.Urgency
+		Since          int64
+		DueBy          int64
+		Waiting        statemachine.Actor
+	}
+	overdueList := []overdueReferral{}
+	for _, overdue := range jobs.FindOverdue(rh.Database, time.Now()) {
+		referral := overdue.Referral
+		if referral.Origin != clientHospitalId && referral.Destination != clientHospitalId {
+			// pending candidate of a broadcast referral
+			candidate, ok := rh.Database.GetCandidate(referral.Id, clientHospitalId)
+			if !ok || candidate.Status != db.CandidatePending {
+				continue
+			}
+		}
+		overdueList = append(overdueList, overdueReferral{
+			Id:             referral.Id,
+			ReferralStatus: referral.ReferralStatus,
+			Origin:         referral.Origin,
+			Destination:    referral.Destination,
+			Urgency:        referral.Urgency,
+			Since:          overdue.Since,
+			DueBy:          overdue.DueBy,
+			Waiting:        overdue.Waiting,
+		})
+	}
+	overdueJson, err := json.Marshal(overdueList)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode overdue referrals")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"referrals":%s}`, string(overdueJson))
+}
+
+// Destination refuses a payload it could not verify
+func (rh *RouteHander) Reject(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	// Semantic Check
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	actor, ok := statemachine.HospitalActor(referral, clientHospitalId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to reject referral")
+		return
+	}
+	err = statemachine.Apply(rh.Database, referral, statemachine.Trigger{
+		Actor:   actor,
+		ActorId: clientHospitalId,
+	}, db.Rejected)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not reject: %s", err))
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (rh *RouteHander) GetReferral(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	// Semantic
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	_, isCandidate := rh.Database.GetCandidate(referralId, clientHospitalId)
+	if referral.Destination != clientHospitalId && referral.Origin != clientHospitalId && !isCandidate {
 		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to view referral")
 		return
 	}
@@ -287,12 +947,33 @@ func (rh *RouteHander) GetReferral(w http.ResponseWriter, r *http.Request) {
 		Reason         string
 		Created        int64
 		ReferralStatus db.ReferralStatus
+		DeclineCode    db.DeclineCode
+		DeclineReason  string
+		CounterTo      int
+		Urgency        db.Urgency
+		Deadline       int64
+		Forwards       []db.ReferralForward
+		Candidates     []db.ReferralCandidate `json:",omitempty"`
 	}{
 		ReferralObject: referral.ReferralObject,
 		PatientObject:  referral.PatientObject,
 		Reason:         referral.Reason,
 		Created:        referral.Created,
 		ReferralStatus: referral.ReferralStatus,
+		DeclineCode:    referral.DeclineCode,
+		DeclineReason:  referral.DeclineReason,
+		CounterTo:      referral.CounterTo,
+		Urgency:        referral.Urgency,
+		Deadline:       referral.Deadline,
+	}
+	resultReferral.Forwards, ok = rh.Database.GetForwardsByReferral(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 500, "Could not get forwarding chain")
+		return
+	}
+	// other candidates' answers are for the origin only
+	if referral.Origin == clientHospitalId {
+		resultReferral.Candidates, _ = rh.Database.GetCandidatesByReferral(referralId)
 	}
 
 	w.WriteHeader(200)
@@ -318,3 +999,30 @@ func (rh *RouteHander) GetHospitals(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Fprint(w, string(hospitalsJson))
 }
+
+func (rh *RouteHander) GetHospitalKeys(w http.ResponseWriter, r *http.Request) {
+	hospitals, ok := rh.Database.GetHospitals()
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Could not find hospitals")
+		return
+	}
+	// Work
+	keys := []lib.HospitalKey{}
+	for _, hospital := range hospitals {
+		// Hospitals that never connected have no certificate yet
+		if hospital.Certificate == "" {
+			continue
+		}
+		keys = append(keys, lib.HospitalKey{
+			HospitalId:  hospital.HospitalId,
+			CertSerial:  hospital.CertSerial,
+			Certificate: hospital.Certificate,
+		})
+	}
+	keysJson, err := json.Marshal(keys)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode hospital keys")
+		return
+	}
+	fmt.Fprint(w, string(keysJson))
+}
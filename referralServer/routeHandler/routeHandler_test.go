@@ -1,16 +1,24 @@
 package routehandler_test
 
 import (
+	"bufio"
 	"bytes"
+	"crypto"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
 	"simplemts/lib"
 	db "simplemts/lib/database"
+	statemachine "simplemts/lib/stateMachine"
 	testhelper "simplemts/lib/testHelper"
 	routehandler "simplemts/referralServer/routeHandler"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -150,7 +158,7 @@ func TestPollIncoming(t *testing.T) {
 			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
 			return
 		}
-		match, _ := regexp.MatchString(`^{"referrals":\[({"Id":[^,]*,"ReferralStatus":"[^"]*"},?)*\]}$`, got)
+		match, _ := regexp.MatchString(`^{"referrals":\[({"Id":[^,]*,"ReferralStatus":"[^"]*"},?)*\],"cursor":\d+}$`, got)
 		if !match {
 			t.Errorf(`Unexpected response: "%s"`, got)
 			return
@@ -159,7 +167,10 @@ func TestPollIncoming(t *testing.T) {
 }
 
 func TestPollOutgoing(t *testing.T) {
-	clientHospitalId := destinationHospitalId
+	clientHospitalId := originHospitalId
+	// other tests leave referrals behind, only this one is looked for
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	handler.Database.UpdateStatusReferralById(referralId, db.Granted)
 	t.Run("Normal", func(t *testing.T) {
 		request, _ := http.NewRequest(http.MethodGet, "/", nil)
 		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
@@ -174,11 +185,25 @@ func TestPollOutgoing(t *testing.T) {
 			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
 			return
 		}
-		match, _ := regexp.MatchString(`^{"referrals":\[({"Id":[^,]*,"ReferralStatus":"[^"]*"},?)*\]}$`, got)
-		if !match {
+		type polled struct {
+			Id             int
+			ReferralStatus db.ReferralStatus
+			Seq            int64
+		}
+		outgoing := struct {
+			Referrals []polled `json:"referrals"`
+			Cursor    int64    `json:"cursor"`
+		}{}
+		if err := json.Unmarshal(response.Body.Bytes(), &outgoing); err != nil {
 			t.Errorf(`Unexpected response: "%s"`, got)
 			return
 		}
+		idx := slices.IndexFunc(outgoing.Referrals, func(r polled) bool {
+			return r.Id == referralId
+		})
+		if idx < 0 || outgoing.Referrals[idx].ReferralStatus != db.Granted || outgoing.Referrals[idx].Seq > outgoing.Cursor {
+			t.Errorf("Want referral %d Granted within cursor %d, Got %s", referralId, outgoing.Cursor, got)
+		}
 	})
 }
 
@@ -213,9 +238,21 @@ func TestGrant(t *testing.T) {
 	referralId, _ = testhelper.CreateMockReferral(handler.Database)
 	t.Logf("Created Referral %d\n", referralId)
 	handler.Database.UpdateStatusReferralById(referralId, db.Consented)
+	t.Run("Not Grant without reason", func(t *testing.T) {
+		response := grant(referralId, clientHospitalId, `{"Granted": false}`)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+		response = grant(referralId, clientHospitalId, `{"Granted": false, "DeclineCode": "Busy"}`)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
 	t.Run("Normal Not Grant", func(t *testing.T) {
 		bodyReader := bytes.NewReader([]byte(`{
-			"Granted": false
+			"Granted": false,
+			"DeclineCode": "NoCapacity",
+			"DeclineReason": "No beds until next month"
 		}`))
 		request, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/%d/grant", referralId), bodyReader)
 		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
@@ -235,25 +272,122 @@ func TestGrant(t *testing.T) {
 			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
 			return
 		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		if referral.DeclineCode != db.NoCapacity || referral.DeclineReason != "No beds until next month" {
+			t.Errorf("got %q %q, want decline reason stored", referral.DeclineCode, referral.DeclineReason)
+		}
+	})
+	referralId, _ = testhelper.CreateMockReferral(handler.Database)
+	handler.Database.UpdateStatusReferralById(referralId, db.Consented)
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		codes := make(chan int, 4)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(body string) {
+				defer wg.Done()
+				codes <- grant(referralId, clientHospitalId, body).Code
+			}([]string{`{"Granted": true}`, `{"Granted": false, "DeclineCode": "Other"}`}[i%2])
+		}
+		wg.Wait()
+		close(codes)
+		granted := 0
+		for code := range codes {
+			switch code {
+			case 200:
+				granted++
+			case 400, 409:
+			default:
+				t.Errorf("got %d, want 200, 400 or 409", code)
+			}
+		}
+		if granted != 1 {
+			t.Errorf("got %d successful grants, want 1", granted)
+		}
+	})
+}
+
+func grant(referralId int, clientHospitalId string, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/%d/grant", referralId), strings.NewReader(body))
+	requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+	requestWithVars := mux.SetURLVars(requestWithContext, map[string]string{
+		"referralId": fmt.Sprint(referralId),
+	})
+	response := httptest.NewRecorder()
+	handler.GrantReferral(response, requestWithVars)
+	return response
+}
+
+func complete(referralId int, clientHospitalId string, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/%d/complete", referralId), strings.NewReader(body))
+	requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+	// Vars
+	vars := map[string]string{
+		"referralId": fmt.Sprint(referralId),
+	}
+	requestWithVars := mux.SetURLVars(requestWithContext, vars)
+	response := httptest.NewRecorder()
+	handler.Complete(response, requestWithVars)
+	return response
+}
+
+func signedReceipt(t *testing.T, privateKey crypto.PrivateKey, receipt lib.Receipt) string {
+	receiptJson, signature, err := lib.SignReceipt(privateKey, receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]string{
+		"Receipt":          receiptJson,
+		"ReceiptSignature": signature,
 	})
+	return string(body)
 }
 
 func TestComplete(t *testing.T) {
 	clientHospitalId := destinationHospitalId
+	_, privateKey, err := testhelper.CreateMockHospitalCertificate(handler.Database, destinationHospitalId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, _ := testhelper.CreateMockCertificate("other")
 	referralId, _ := testhelper.CreateMockReferral(handler.Database)
 	t.Logf("Created Referral %d\n", referralId)
 	handler.Database.UpdateStatusReferralById(referralId, db.UploadComplete)
-	t.Run("Normal", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/%d/complete", referralId), nil)
-		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
-		// Vars
-		vars := map[string]string{
-			"referralId": fmt.Sprint(referralId),
+	testhelper.CreateMockFiles(handler.Database, referralId, "", []db.FileObject{
+		{Name: "a", Checksum: "1"},
+		{Name: "b", Checksum: "2"},
+	})
+	receipt := lib.Receipt{
+		ReferralId:  referralId,
+		Destination: destinationHospitalId,
+		Files: []lib.ManifestFile{
+			{Name: "a", Checksum: "1"},
+			{Name: "b", Checksum: "2"},
+		},
+		Timestamp: time.Now().Unix(),
+	}
+	t.Run("No receipt", func(t *testing.T) {
+		response := complete(referralId, clientHospitalId, "")
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
 		}
-		requestWithVars := mux.SetURLVars(requestWithContext, vars)
-		response := httptest.NewRecorder()
-		handler.Complete(response, requestWithVars)
-
+	})
+	t.Run("Wrong signer", func(t *testing.T) {
+		response := complete(referralId, clientHospitalId, signedReceipt(t, otherKey, receipt))
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Wrong files", func(t *testing.T) {
+		wrong := receipt
+		wrong.Files = []lib.ManifestFile{{Name: "a", Checksum: "1"}}
+		response := complete(referralId, clientHospitalId, signedReceipt(t, privateKey, wrong))
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Normal", func(t *testing.T) {
+		response := complete(referralId, clientHospitalId, signedReceipt(t, privateKey, receipt))
 		gotstatus := response.Result().StatusCode
 		got := response.Body.String()
 		wantstatus := 200
@@ -262,5 +396,652 @@ func TestComplete(t *testing.T) {
 			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
 			return
 		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		if referral.ReferralStatus != db.Complete || referral.Receipt == "" {
+			t.Errorf("Receipt was not stored: %s", referral.ReferralStatus)
+		}
+	})
+}
+
+func TestGetReceipt(t *testing.T) {
+	cert, privateKey, err := testhelper.CreateMockHospitalCertificate(handler.Database, destinationHospitalId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	handler.Database.UpdateStatusReferralById(referralId, db.UploadComplete)
+	testhelper.CreateMockFiles(handler.Database, referralId, "", []db.FileObject{{Name: "a", Checksum: "1"}})
+	getReceipt := func(clientHospitalId string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/%d/receipt", referralId), nil)
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		requestWithVars := mux.SetURLVars(requestWithContext, map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		})
+		response := httptest.NewRecorder()
+		handler.GetReceipt(response, requestWithVars)
+		return response
+	}
+	t.Run("Not complete", func(t *testing.T) {
+		response := getReceipt(originHospitalId)
+		if response.Code != 404 {
+			t.Errorf("got %d, want 404: response: %s", response.Code, response.Body.String())
+		}
+	})
+	complete(referralId, destinationHospitalId, signedReceipt(t, privateKey, lib.Receipt{
+		ReferralId:  referralId,
+		Destination: destinationHospitalId,
+		Files:       []lib.ManifestFile{{Name: "a", Checksum: "1"}},
+		Timestamp:   time.Now().Unix(),
+	}))
+	t.Run("Other hospital", func(t *testing.T) {
+		response := getReceipt("other")
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Origin verifies", func(t *testing.T) {
+		response := getReceipt(originHospitalId)
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+			return
+		}
+		stored := struct {
+			Receipt          string
+			ReceiptSignature string
+			Certificate      string
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &stored)
+		if stored.Certificate != lib.EncodeCertificatePEM(cert) {
+			t.Errorf("Receipt certificate differs")
+		}
+		receipt, err := lib.VerifyReceipt(cert, stored.Receipt, stored.ReceiptSignature)
+		if err != nil || receipt.ReferralId != referralId {
+			t.Errorf("Could not verify receipt: %v", err)
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	handler.Database.UpdateStatusReferralById(referralId, db.Consented)
+	grant(referralId, destinationHospitalId, `{"Granted": true}`)
+	getHistory := func(clientHospitalId string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/%d/history", referralId), nil)
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		requestWithVars := mux.SetURLVars(requestWithContext, map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		})
+		response := httptest.NewRecorder()
+		handler.GetHistory(response, requestWithVars)
+		return response
+	}
+	t.Run("Other hospital", func(t *testing.T) {
+		response := getHistory("other")
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Normal", func(t *testing.T) {
+		response := getHistory(originHospitalId)
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+			return
+		}
+		history := struct {
+			Events []db.ReferralEvent `json:"events"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &history)
+		if len(history.Events) != 1 {
+			t.Fatalf("got %d events, want 1: response: %s", len(history.Events), response.Body.String())
+		}
+		event := history.Events[0]
+		if event.FromStatus != db.Consented || event.ToStatus != db.Granted ||
+			event.Actor != "Destination" || event.ActorId != destinationHospitalId {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	})
+}
+
+func TestCounterReferral(t *testing.T) {
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	counter := func(clientHospitalId string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/%d/counter", referralId),
+			strings.NewReader(`{"Reason": "Discharge summary"}`))
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		requestWithVars := mux.SetURLVars(requestWithContext, map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		})
+		response := httptest.NewRecorder()
+		handler.CreateCounterReferral(response, requestWithVars)
+		return response
+	}
+	t.Run("Not complete", func(t *testing.T) {
+		response := counter(destinationHospitalId)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	handler.Database.UpdateStatusReferralById(referralId, db.Complete)
+	t.Run("Origin", func(t *testing.T) {
+		response := counter(originHospitalId)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Normal", func(t *testing.T) {
+		response := counter(destinationHospitalId)
+		if response.Code != 201 {
+			t.Errorf("got %d, want 201: response: %s", response.Code, response.Body.String())
+			return
+		}
+		created := struct {
+			Id int `json:"id"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &created)
+		referral, _ := handler.Database.GetReferralById(created.Id)
+		if referral.Origin != destinationHospitalId || referral.Destination != originHospitalId ||
+			referral.CounterTo != referralId || referral.ReferralStatus != db.CounterCreated {
+			t.Errorf("Unexpected counter-referral %s to %s for %d in %s",
+				referral.Origin, referral.Destination, referral.CounterTo, referral.ReferralStatus)
+		}
+		// listed for the original origin
+		request, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/%d/counter", referralId), nil)
+		requestWithContext := lib.AddHospitalContext(request, originHospitalId)
+		requestWithVars := mux.SetURLVars(requestWithContext, map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		})
+		listResponse := httptest.NewRecorder()
+		handler.GetCounterReferrals(listResponse, requestWithVars)
+		list := struct {
+			Referrals []struct{ Id int } `json:"referrals"`
+		}{}
+		json.Unmarshal(listResponse.Body.Bytes(), &list)
+		if len(list.Referrals) != 1 || list.Referrals[0].Id != created.Id {
+			t.Errorf("got %s, want counter-referral %d", listResponse.Body.String(), created.Id)
+		}
+	})
+}
+
+func TestForward(t *testing.T) {
+	forward := func(referralId int, clientHospitalId string, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/%d/forward", referralId), strings.NewReader(body))
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		requestWithVars := mux.SetURLVars(requestWithContext, map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		})
+		response := httptest.NewRecorder()
+		handler.ForwardReferral(response, requestWithVars)
+		return response
+	}
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	handler.Database.UpdateStatusReferralById(referralId, db.Consented)
+	t.Run("Unknown hospital", func(t *testing.T) {
+		response := forward(referralId, destinationHospitalId, `{"Destination": "unknown", "Reason": "No beds"}`)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Back to origin", func(t *testing.T) {
+		response := forward(referralId, destinationHospitalId,
+			fmt.Sprintf(`{"Destination": "%s", "Reason": "No beds"}`, originHospitalId))
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Origin", func(t *testing.T) {
+		response := forward(referralId, originHospitalId, `{"Destination": "2222", "Reason": "No beds"}`)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Normal", func(t *testing.T) {
+		response := forward(referralId, destinationHospitalId, `{"Destination": "2222", "Reason": "No beds"}`)
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+			return
+		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		if referral.ReferralStatus != db.Forwarded || referral.Destination != "2222" {
+			t.Errorf("got %s at %s, want %s at 2222", referral.ReferralStatus, referral.Destination, db.Forwarded)
+		}
+		forwards, _ := handler.Database.GetForwardsByReferral(referralId)
+		if len(forwards) != 1 || forwards[0].FromHospital != destinationHospitalId || forwards[0].ToHospital != "2222" {
+			t.Errorf("Unexpected forwarding chain %+v", forwards)
+		}
+	})
+	t.Run("Stored payload needs key", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(handler.Database)
+		handler.Database.UpdateStatusReferralById(referralId, db.Complete)
+		handler.Database.UpdatePayloadKeyById(referralId, lib.WrappedKeyPrefix+"b2xk")
+		response := forward(referralId, destinationHospitalId, `{"Destination": "2222", "Reason": "No beds"}`)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+		response = forward(referralId, destinationHospitalId,
+			fmt.Sprintf(`{"Destination": "2222", "Reason": "No beds", "PayloadKey": "%sbmV3"}`, lib.WrappedKeyPrefix))
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+			return
+		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		if referral.PayloadKey != lib.WrappedKeyPrefix+"bmV3" {
+			t.Errorf("got key %q, want the key wrapped for the new destination", referral.PayloadKey)
+		}
+		// new destination grants before it can download the payload
+		err := statemachine.Apply(handler.Database, referral, statemachine.Trigger{Actor: statemachine.Patient}, db.Consented)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response = grant(referralId, "2222", `{"Granted": true}`)
+		if response.Code != 200 {
+			t.Fatalf("got %d, want 200: response: %s", response.Code, response.Body.String())
+		}
+		referral, _ = handler.Database.GetReferralById(referralId)
+		if referral.ReferralStatus != db.UploadComplete {
+			t.Errorf("got %s, want %s", referral.ReferralStatus, db.UploadComplete)
+		}
+		events, _ := handler.Database.GetEventsByReferral(referralId)
+		if !slices.ContainsFunc(events, func(event db.ReferralEvent) bool { return event.ToStatus == db.Granted }) {
+			t.Errorf("Grant missing from history %+v", events)
+		}
+	})
+}
+
+func createBroadcast(t *testing.T, candidates []string) (referralId int) {
+	referralId, _ = testhelper.CreateMockReferral(handler.Database)
+	handler.Database.UpdateStatusReferralById(referralId, db.Consented)
+	list := []db.ReferralCandidate{}
+	for _, hospitalId := range candidates {
+		list = append(list, db.ReferralCandidate{Referral: referralId, HospitalId: hospitalId, Status: db.CandidatePending})
+	}
+	if !handler.Database.CreateReferralCandidates(list) {
+		t.Fatal("Could not create candidates")
+	}
+	return
+}
+
+func TestBroadcast(t *testing.T) {
+	candidates := []string{destinationHospitalId, "2222", "3333"}
+	t.Run("First grant wins", func(t *testing.T) {
+		referralId := createBroadcast(t, candidates)
+		var wg sync.WaitGroup
+		codes := make(chan int, len(candidates))
+		for _, hospitalId := range candidates {
+			wg.Add(1)
+			go func(hospitalId string) {
+				defer wg.Done()
+				codes <- grant(referralId, hospitalId, `{"Granted": true}`).Code
+			}(hospitalId)
+		}
+		wg.Wait()
+		close(codes)
+		granted := 0
+		for code := range codes {
+			switch code {
+			case 200:
+				granted++
+			case 409:
+			default:
+				t.Errorf("got %d, want 200 or 409", code)
+			}
+		}
+		if granted != 1 {
+			t.Fatalf("got %d successful grants, want 1", granted)
+		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		for _, hospitalId := range candidates {
+			candidate, _ := handler.Database.GetCandidate(referralId, hospitalId)
+			want := db.CandidateUnavailable
+			if hospitalId == referral.Destination {
+				want = db.CandidateClaimed
+			}
+			if candidate.Status != want {
+				t.Errorf("%s: got %s, want %s", hospitalId, candidate.Status, want)
+			}
+		}
+		if referral.ReferralStatus != db.Granted || !slices.Contains(candidates, referral.Destination) {
+			t.Errorf("got %s at %s, want %s at a candidate", referral.ReferralStatus, referral.Destination, db.Granted)
+		}
+	})
+	t.Run("Others are told", func(t *testing.T) {
+		referralId := createBroadcast(t, candidates)
+		grant(referralId, "2222", `{"Granted": true}`)
+		request, _ := http.NewRequest(http.MethodGet, "/incoming", nil)
+		response := httptest.NewRecorder()
+		handler.Poll(response, lib.AddHospitalContext(request, "3333"), false)
+		incoming := struct {
+			Referrals []struct {
+				Id              int
+				CandidateStatus db.CandidateStatus
+			} `json:"referrals"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &incoming)
+		idx := slices.IndexFunc(incoming.Referrals, func(r struct {
+			Id              int
+			CandidateStatus db.CandidateStatus
+		}) bool {
+			return r.Id == referralId
+		})
+		if idx < 0 || incoming.Referrals[idx].CandidateStatus != db.CandidateUnavailable {
+			t.Errorf("Want referral %d unavailable in %s", referralId, response.Body.String())
+		}
+		late := grant(referralId, "3333", `{"Granted": true}`)
+		if late.Code != 409 {
+			t.Errorf("got %d, want 409: response: %s", late.Code, late.Body.String())
+		}
+	})
+	t.Run("Declined by all", func(t *testing.T) {
+		referralId := createBroadcast(t, candidates[:2])
+		response := grant(referralId, candidates[0], `{"Granted": false, "DeclineCode": "NoCapacity"}`)
+		referral, _ := handler.Database.GetReferralById(referralId)
+		if response.Code != 200 || referral.ReferralStatus != db.Consented {
+			t.Errorf("got %d %s, want 200 %s", response.Code, referral.ReferralStatus, db.Consented)
+		}
+		response = grant(referralId, candidates[1], `{"Granted": false, "DeclineCode": "WrongDepartment"}`)
+		referral, _ = handler.Database.GetReferralById(referralId)
+		if response.Code != 200 || referral.ReferralStatus != db.NotGranted {
+			t.Errorf("got %d %s, want 200 %s", response.Code, referral.ReferralStatus, db.NotGranted)
+		}
+		if referral.DeclineCode != db.WrongDepartment {
+			t.Errorf("got %q, want the last decline code stored", referral.DeclineCode)
+		}
+	})
+}
+
+func TestUrgency(t *testing.T) {
+	create := func(urgency db.Urgency) *httptest.ResponseRecorder {
+		body := testhelper.GenerateMockCreation(Creation{
+			ReferralObject: db.ReferralObject{Destination: "3333"},
+			Urgency:        urgency,
+		})
+		request, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		requestWithContext := lib.AddHospitalContext(request, originHospitalId)
+		response := httptest.NewRecorder()
+		handler.CreateReferral(response, requestWithContext)
+		return response
+	}
+	t.Run("Wrong urgency", func(t *testing.T) {
+		response := create("soon")
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Deadline", func(t *testing.T) {
+		response := create(db.Emergency)
+		if response.Code != 201 {
+			t.Fatalf("got %d, want 201: response: %s", response.Code, response.Body.String())
+		}
+		created := struct {
+			Id int `json:"id"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &created)
+		referral, _ := handler.Database.GetReferralById(created.Id)
+		want := time.Now().Add(lib.ResponseWindow(db.Emergency)).Unix()
+		if referral.Urgency != db.Emergency || referral.Deadline < want-5 || referral.Deadline > want {
+			t.Errorf("got %s deadline %d, want %s deadline %d", referral.Urgency, referral.Deadline, db.Emergency, want)
+		}
+	})
+	t.Run("Incoming by priority", func(t *testing.T) {
+		for _, urgency := range []db.Urgency{db.Routine, "", db.Urgent, db.Emergency} {
+			if response := create(urgency); response.Code != 201 {
+				t.Fatalf("got %d, want 201: response: %s", response.Code, response.Body.String())
+			}
+		}
+		request, _ := http.NewRequest(http.MethodGet, "/incoming", nil)
+		response := httptest.NewRecorder()
+		handler.Poll(response, lib.AddHospitalContext(request, "3333"), false)
+		incoming := struct {
+			Referrals []struct {
+				Urgency  db.Urgency
+				Deadline int64
+			} `json:"referrals"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &incoming)
+		for i := 1; i < len(incoming.Referrals); i++ {
+			a, b := incoming.Referrals[i-1], incoming.Referrals[i]
+			if a.Urgency.Priority() > b.Urgency.Priority() ||
+				(a.Urgency == b.Urgency && a.Deadline > b.Deadline) {
+				t.Errorf("Unsorted incoming: %s", response.Body.String())
+				break
+			}
+		}
+	})
+}
+
+func TestOverdue(t *testing.T) {
+	t.Setenv("SLA_CREATED_MIN", "0")
+	request, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(testhelper.GenerateMockCreation(Creation{})))
+	response := httptest.NewRecorder()
+	handler.CreateReferral(response, lib.AddHospitalContext(request, originHospitalId))
+	created := struct {
+		Id int `json:"id"`
+	}{}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if response.Code != 201 || created.Id == 0 {
+		t.Fatalf("Could not create referral: %s", response.Body.String())
+	}
+	listed := func(hospitalId string) bool {
+		request, _ := http.NewRequest(http.MethodGet, "/overdue", nil)
+		response := httptest.NewRecorder()
+		handler.GetOverdue(response, lib.AddHospitalContext(request, hospitalId))
+		overdue := struct {
+			Referrals []struct {
+				Id      int
+				Waiting string
+			} `json:"referrals"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &overdue)
+		for _, referral := range overdue.Referrals {
+			if referral.Id == created.Id {
+				return referral.Waiting == "Patient"
+			}
+		}
+		return false
+	}
+	for _, c := range []struct {
+		name       string
+		hospitalId string
+		want       bool
+	}{
+		{"Origin", originHospitalId, true},
+		{"Destination", destinationHospitalId, true},
+		{"Other hospital", "99999", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := listed(c.hospitalId); got != c.want {
+				t.Errorf("got listed %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPollSince(t *testing.T) {
+	const pollHospitalId = "4444"
+	poll := func(query string) (code int, ids []int, cursor int64) {
+		request, _ := http.NewRequest(http.MethodGet, "/incoming"+query, nil)
+		response := httptest.NewRecorder()
+		handler.Poll(response, lib.AddHospitalContext(request, pollHospitalId), false)
+		incoming := struct {
+			Referrals []struct {
+				Id  int
+				Seq int64
+			} `json:"referrals"`
+			Cursor int64 `json:"cursor"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &incoming)
+		for _, referral := range incoming.Referrals {
+			if referral.Seq > incoming.Cursor {
+				t.Errorf("Seq %d past cursor %d", referral.Seq, incoming.Cursor)
+			}
+			ids = append(ids, referral.Id)
+		}
+		return response.Code, ids, incoming.Cursor
+	}
+	body := testhelper.GenerateMockCreation(Creation{ReferralObject: db.ReferralObject{Destination: pollHospitalId}})
+	request, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	handler.CreateReferral(response, lib.AddHospitalContext(request, originHospitalId))
+	created := struct {
+		Id int `json:"id"`
+	}{}
+	json.Unmarshal(response.Body.Bytes(), &created)
+
+	_, ids, cursor := poll("")
+	if !slices.Contains(ids, created.Id) {
+		t.Fatalf("Want referral %d in full listing, Got %v", created.Id, ids)
+	}
+	t.Run("Unchanged", func(t *testing.T) {
+		_, ids, next := poll(fmt.Sprintf("?since=%d", cursor))
+		if len(ids) != 0 || next != cursor {
+			t.Errorf("Want no referrals and cursor %d, Got %v cursor %d", cursor, ids, next)
+		}
+	})
+	t.Run("Changed", func(t *testing.T) {
+		database.TransitionReferral(created.Id, db.Created, db.Consented)
+		_, ids, next := poll(fmt.Sprintf("?since=%d", cursor))
+		if !slices.Equal(ids, []int{created.Id}) || next <= cursor {
+			t.Errorf("Want referral %d and cursor past %d, Got %v cursor %d", created.Id, cursor, ids, next)
+		}
+	})
+	t.Run("Invalid cursor", func(t *testing.T) {
+		if code, _, _ := poll("?since=a"); code != 400 {
+			t.Errorf("got %d, want 400", code)
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	const streamHospitalId = "5555"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.Events(w, lib.AddHospitalContext(r, streamHospitalId))
+	}))
+	defer server.Close()
+	t.Run("Invalid cursor", func(t *testing.T) {
+		response, err := http.Get(server.URL + "?since=a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != 400 {
+			t.Errorf("got %d, want 400", response.StatusCode)
+		}
+	})
+	t.Run("Pushed change", func(t *testing.T) {
+		// only changes from here on
+		request, _ := http.NewRequest(http.MethodGet, "/incoming", nil)
+		polled := httptest.NewRecorder()
+		handler.Poll(polled, lib.AddHospitalContext(request, streamHospitalId), false)
+		incoming := struct {
+			Cursor int64 `json:"cursor"`
+		}{}
+		json.Unmarshal(polled.Body.Bytes(), &incoming)
+
+		response, err := http.Get(fmt.Sprintf("%s?since=%d", server.URL, incoming.Cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		if got := response.Header.Get("Content-Type"); got != "text/event-stream" {
+			t.Errorf("got %s, want text/event-stream", got)
+		}
+		referralId, _ := testhelper.CreateMockReferral(handler.Database)
+		database.UpdateStatusReferralById(referralId, db.Consented)
+		database.TransitionReferralUpdates(db.ReferralEvent{Referral: referralId, FromStatus: db.Consented, ToStatus: db.Forwarded},
+			map[string]interface{}{"destination": streamHospitalId})
+
+		lines := make(chan string, 64)
+		go func() {
+			scanner := bufio.NewScanner(response.Body)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			close(lines)
+		}()
+		timeout := time.After(5 * time.Second)
+		event := ""
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatal("Stream closed")
+				}
+				if strings.HasPrefix(line, "event: ") {
+					event = strings.TrimPrefix(line, "event: ")
+				}
+				if !strings.HasPrefix(line, "data: ") {
+					continue
+				}
+				pushed := struct {
+					Id             int
+					ReferralStatus db.ReferralStatus
+				}{}
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &pushed)
+				if pushed.Id != referralId {
+					continue
+				}
+				if event != "incoming" || pushed.ReferralStatus != db.Forwarded {
+					t.Errorf("got %s %s, want incoming %s", event, pushed.ReferralStatus, db.Forwarded)
+				}
+				return
+			case <-timeout:
+				t.Fatal("No event for the forwarded referral")
+			}
+		}
+	})
+}
+
+func TestWebhook(t *testing.T) {
+	const webhookHospitalId = "3333"
+	register := func(url string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, "/webhook", strings.NewReader(fmt.Sprintf(`{"URL":"%s"}`, url)))
+		response := httptest.NewRecorder()
+		handler.RegisterWebhook(response, lib.AddHospitalContext(request, webhookHospitalId))
+		return response
+	}
+	t.Run("Not https", func(t *testing.T) {
+		if response := register("http://example.com/hook"); response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Registered", func(t *testing.T) {
+		response := register("https://example.com/hook")
+		registered := struct {
+			URL    string
+			Secret string
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &registered)
+		if response.Code != 200 || len(registered.Secret) != 64 {
+			t.Fatalf("got %d, want 200 with a secret: response: %s", response.Code, response.Body.String())
+		}
+		hospital, _ := database.GetHospitalByHospitalId(webhookHospitalId)
+		if hospital.WebhookURL != registered.URL || hospital.WebhookSecret != registered.Secret {
+			t.Errorf("Webhook not stored: %s", hospital.WebhookURL)
+		}
+	})
+	t.Run("Deliveries", func(t *testing.T) {
+		referralId, _ := database.CreateReferralServer(db.Referral{
+			ReferralObject: db.ReferralObject{Origin: originHospitalId, Destination: webhookHospitalId},
+		})
+		database.CreateReferralEvent(db.ReferralEvent{Referral: referralId, ToStatus: db.Created})
+		request, _ := http.NewRequest(http.MethodGet, "/webhook/deliveries", nil)
+		response := httptest.NewRecorder()
+		handler.GetWebhookDeliveries(response, lib.AddHospitalContext(request, webhookHospitalId))
+		deliveryLog := struct {
+			Deliveries []db.WebhookDelivery `json:"deliveries"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &deliveryLog)
+		if response.Code != 200 || len(deliveryLog.Deliveries) == 0 || deliveryLog.Deliveries[0].Referral != referralId ||
+			deliveryLog.Deliveries[0].Status != db.DeliveryPending {
+			t.Errorf("got %d, want pending delivery for %d: response: %s", response.Code, referralId, response.Body.String())
+		}
+	})
+	t.Run("Removed", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodDelete, "/webhook", nil)
+		response := httptest.NewRecorder()
+		handler.RemoveWebhook(response, lib.AddHospitalContext(request, webhookHospitalId))
+		hospital, _ := database.GetHospitalByHospitalId(webhookHospitalId)
+		if response.Code != 200 || hospital.WebhookURL != "" {
+			t.Errorf("got %d, want 200 and no webhook", response.Code)
+		}
 	})
 }
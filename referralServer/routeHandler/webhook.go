@@ -0,0 +1,85 @@
+package routehandler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"simplemts/lib"
+	"strconv"
+	"strings"
+)
+
+// Registers the calling hospital's webhook, a new secret is returned every time
+func (rh *RouteHander) RegisterWebhook(w http.ResponseWriter, r *http.Request) {
+	clientHospitalId := lib.GetContextHospital(r)
+	request := struct {
+		URL string `json:"URL" validate:"required,url"`
+	}{}
+	err := lib.DecodeValidate(&request, r.Body)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	if !strings.HasPrefix(request.URL, "https://") {
+		lib.ErrorMessageHandler(w, r, 400, "Webhook URL must be https")
+		return
+	}
+	// Work
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		lib.ErrorMessageHandler(w, r, 500, "Could not create secret")
+		return
+	}
+	if !rh.Database.UpdateHospitalWebhook(clientHospitalId, request.URL, hex.EncodeToString(secret)) {
+		lib.ErrorMessageHandler(w, r, 500, "Could not register webhook")
+		return
+	}
+	response, err := json.Marshal(struct {
+		URL    string
+		Secret string
+	}{request.URL, hex.EncodeToString(secret)})
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, "Could not encode webhook")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprint(w, string(response))
+}
+
+// Queued deliveries are given up once they come due
+func (rh *RouteHander) RemoveWebhook(w http.ResponseWriter, r *http.Request) {
+	clientHospitalId := lib.GetContextHospital(r)
+	if !rh.Database.UpdateHospitalWebhook(clientHospitalId, "", "") {
+		lib.ErrorMessageHandler(w, r, 500, "Could not remove webhook")
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// Latest deliveries to the calling hospital, ?limit= up to 500
+func (rh *RouteHander) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	clientHospitalId := lib.GetContextHospital(r)
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > 500 {
+			lib.ErrorMessageHandler(w, r, 400, "Invalid limit")
+			return
+		}
+	}
+	deliveries, ok := rh.Database.GetDeliveriesByHospital(clientHospitalId, limit)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 500, "Could not get deliveries")
+		return
+	}
+	deliveriesJson, err := json.Marshal(deliveries)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode deliveries")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"deliveries":%s}`, string(deliveriesJson))
+}
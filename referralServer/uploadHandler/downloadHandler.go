@@ -3,12 +3,12 @@ package uploadhandler
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"path"
 	"simplemts/lib"
 	db "simplemts/lib/database"
+	statemachine "simplemts/lib/stateMachine"
 
 	"github.com/gorilla/mux"
 )
@@ -31,7 +31,9 @@ func (rh *UploadHandler) GetFiles(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, "Destination mismatch: client does not have permission to get files")
 		return
 	}
-	if referral.ReferralStatus != db.UploadComplete { // TODO send extra data, can upload again
+	// listed again after completion, the destination needs the key to forward the referral
+	flow := statemachine.Flow(referral)
+	if referral.ReferralStatus != flow.Uploaded && referral.ReferralStatus != flow.Downloaded {
 		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not get file list: referral is in state %s", referral.ReferralStatus))
 		return
 	}
@@ -47,8 +49,10 @@ func (rh *UploadHandler) GetFiles(w http.ResponseWriter, r *http.Request) {
 		Checksum     string          `json:"Checksum"`
 	}
 	response := struct {
-		Files      []fileItem `json:"Files"`
-		PayloadKey string     `json:"PayloadKey"`
+		Files             []fileItem `json:"Files"`
+		PayloadKey        string     `json:"PayloadKey"`
+		Manifest          string     `json:"Manifest"`
+		ManifestSignature string     `json:"ManifestSignature"`
 	}{}
 	for _, file := range files {
 		response.Files = append(response.Files, fileItem{
@@ -58,6 +62,8 @@ func (rh *UploadHandler) GetFiles(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 	response.PayloadKey = referral.PayloadKey
+	response.Manifest = referral.Manifest
+	response.ManifestSignature = referral.ManifestSignature
 	res, err := json.Marshal(response)
 	if err != nil {
 		lib.ErrorMessageHandler(w, r, 400, "Could not encode response")
@@ -88,11 +94,11 @@ func (rh *UploadHandler) DownloadFile(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, "Destination mismatch: client does not have permission to get files")
 		return
 	}
-	if referral.ReferralStatus != db.UploadComplete { // TODO send extra data, can upload again
+	if referral.ReferralStatus != statemachine.Flow(referral).Uploaded { // TODO send extra data, can upload again
 		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not get file: referral is in state %s", referral.ReferralStatus))
 		return
 	}
-	_, ok = rh.Database.GetFileByReferralName(referralId, filename)
+	file, ok := rh.Database.GetFileByReferralName(referralId, filename)
 	if !ok {
 		lib.ErrorMessageHandler(w, r, 400, "Could not get file")
 		return
@@ -107,6 +113,14 @@ func (rh *UploadHandler) DownloadFile(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, "Could not get file")
 		return
 	}
-	w.WriteHeader(200)
-	io.Copy(w, fo)
+	defer fo.Close()
+	stat, err := fo.Stat()
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, "Could not get file")
+		return
+	}
+	// Range and If-Range are handled by ServeContent, ETag lets clients resume the same file
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, file.Checksum))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, filename, stat.ModTime(), fo)
 }
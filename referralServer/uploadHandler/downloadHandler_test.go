@@ -1,6 +1,7 @@
 package uploadhandler_test
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -132,3 +133,71 @@ func TestDownloadFile(t *testing.T) {
 		}
 	})
 }
+
+func TestDownloadFileRange(t *testing.T) {
+	clientHospitalId := destinationHospitalId
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	t.Logf("Created Referral %d\n", referralId)
+	handler.Database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+	data, fileObjects, chunks := createRandomChunks([]string{"a"}, 2)
+	testhelper.CreateMockChunkBegin(&database, referralId, path.Join("", fmt.Sprint(referralId)), fileObjects, handler, chunks)
+	uploadParallel(t, referralId, data)
+	completeUpload(referralId, originHospitalId)
+	whole := append(append([]byte{}, data["a"][0]...), data["a"][1]...)
+	etag := fmt.Sprintf(`"%s"`, fileObjects[0].Checksum)
+
+	download := func(header map[string]string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, "/{referralId}/download/{filename}", nil)
+		for key, value := range header {
+			request.Header.Set(key, value)
+		}
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		vars := map[string]string{
+			"referralId": fmt.Sprint(referralId),
+			"filename":   "a",
+		}
+		requestWithVars := mux.SetURLVars(requestWithContext, vars)
+		response := httptest.NewRecorder()
+		handler.DownloadFile(response, requestWithVars)
+		return response
+	}
+	t.Run("Normal", func(t *testing.T) {
+		response := download(nil)
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+			return
+		}
+		if !bytes.Equal(response.Body.Bytes(), whole) {
+			t.Errorf("Unexpected body")
+		}
+		if response.Header().Get("ETag") != etag {
+			t.Errorf("got ETag %s, want %s", response.Header().Get("ETag"), etag)
+		}
+	})
+	t.Run("Range", func(t *testing.T) {
+		response := download(map[string]string{
+			"Range":    "bytes=1000-",
+			"If-Range": etag,
+		})
+		if response.Code != 206 {
+			t.Errorf("got %d, want 206: response: %s", response.Code, response.Body.String())
+			return
+		}
+		if !bytes.Equal(response.Body.Bytes(), whole[1000:]) {
+			t.Errorf("Unexpected body")
+		}
+	})
+	t.Run("Changed If-Range", func(t *testing.T) {
+		response := download(map[string]string{
+			"Range":    "bytes=1000-",
+			"If-Range": `"other"`,
+		})
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+			return
+		}
+		if !bytes.Equal(response.Body.Bytes(), whole) {
+			t.Errorf("Unexpected body")
+		}
+	})
+}
@@ -0,0 +1,23 @@
+package uploadhandler
+
+import "sync"
+
+// Per-referral locks for upload tracking
+// Chunk rows for one referral are only read and written while holding its lock,
+// different referrals can upload at the same time unless they share a stripe.
+// A fixed number of stripes keeps memory flat however many referrals the server sees
+const lockStripes = 64
+
+type referralLocks struct {
+	stripes [lockStripes]sync.Mutex
+}
+
+func newReferralLocks() *referralLocks {
+	return &referralLocks{}
+}
+
+func (rl *referralLocks) lock(referralId int) (unlock func()) {
+	l := &rl.stripes[uint(referralId)%lockStripes]
+	l.Lock()
+	return l.Unlock
+}
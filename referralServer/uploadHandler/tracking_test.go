@@ -0,0 +1,200 @@
+package uploadhandler_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"simplemts/lib"
+	db "simplemts/lib/database"
+	testhelper "simplemts/lib/testHelper"
+	uploadhandler "simplemts/referralServer/uploadHandler"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Random chunks for each file, with chunk checksums and file checksums
+func createRandomChunks(filenames []string, chunkCount int) (
+	data map[string][][]byte, fileObjects []db.FileObject,
+	chunks map[string][]uploadhandler.Chunk,
+) {
+	data = make(map[string][][]byte)
+	chunks = make(map[string][]uploadhandler.Chunk)
+	for _, name := range filenames {
+		var whole []byte
+		for i := 0; i < chunkCount; i++ {
+			chunk := make([]byte, 1024)
+			rand.Read(chunk)
+			whole = append(whole, chunk...)
+			data[name] = append(data[name], chunk)
+			chunks[name] = append(chunks[name], uploadhandler.Chunk{
+				Checksum: checksum(chunk),
+				SizeKB:   1,
+			})
+		}
+		fileObjects = append(fileObjects, db.FileObject{
+			Name:     name,
+			Checksum: checksum(whole),
+		})
+	}
+	return
+}
+
+func uploadChunk(referralId int, filename string, chunkIndex int,
+	data []byte, clientHospitalId string,
+) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, "/{referralId}/upload/file/{filename}/{chunkIndex}", bytes.NewReader(data))
+	requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+	vars := map[string]string{
+		"referralId": fmt.Sprint(referralId),
+		"filename":   filename,
+		"chunkIndex": fmt.Sprint(chunkIndex),
+	}
+	requestWithVars := mux.SetURLVars(requestWithContext, vars)
+	response := httptest.NewRecorder()
+	handler.ChunkUpload(response, requestWithVars)
+	return response
+}
+
+func completeUpload(referralId int, clientHospitalId string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, "/{referralId}/upload/complete", nil)
+	requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+	vars := map[string]string{
+		"referralId": fmt.Sprint(referralId),
+	}
+	requestWithVars := mux.SetURLVars(requestWithContext, vars)
+	response := httptest.NewRecorder()
+	handler.Complete(response, requestWithVars)
+	return response
+}
+
+// Uploads every chunk of every file at once
+func uploadParallel(t *testing.T, referralId int, data map[string][][]byte) {
+	var wg sync.WaitGroup
+	for name, fileChunks := range data {
+		for i, chunk := range fileChunks {
+			wg.Add(1)
+			go func(name string, i int, chunk []byte) {
+				defer wg.Done()
+				response := uploadChunk(referralId, name, i, chunk, originHospitalId)
+				if response.Code != 200 {
+					t.Errorf("chunk %s/%d: got %d, want 200: response: %s", name, i, response.Code, response.Body.String())
+				}
+			}(name, i, chunk)
+		}
+	}
+	wg.Wait()
+}
+
+func TestParallelUpload(t *testing.T) {
+	filenames := []string{"a", "b", "c"}
+	t.Run("Parallel chunks", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(handler.Database)
+		handler.Database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+		data, fileObjects, chunks := createRandomChunks(filenames, 8)
+		testhelper.CreateMockChunkBegin(&database, referralId, path.Join("", fmt.Sprint(referralId)), fileObjects, handler, chunks)
+
+		uploadParallel(t, referralId, data)
+		response := completeUpload(referralId, originHospitalId)
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Parallel referrals", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for n := 0; n < 4; n++ {
+			referralId, _ := testhelper.CreateMockReferral(handler.Database)
+			handler.Database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+			data, fileObjects, chunks := createRandomChunks(filenames, 4)
+			testhelper.CreateMockChunkBegin(&database, referralId, path.Join("", fmt.Sprint(referralId)), fileObjects, handler, chunks)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				uploadParallel(t, referralId, data)
+				// Completing twice at once merges once
+				var cwg sync.WaitGroup
+				for i := 0; i < 2; i++ {
+					cwg.Add(1)
+					go func() {
+						defer cwg.Done()
+						completeUpload(referralId, originHospitalId)
+					}()
+				}
+				cwg.Wait()
+				referral, _ := handler.Database.GetReferralById(referralId)
+				if referral.ReferralStatus != db.UploadComplete {
+					t.Errorf("referral %d: got %s, want %s", referralId, referral.ReferralStatus, db.UploadComplete)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+	t.Run("Duplicate chunk", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(handler.Database)
+		handler.Database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+		data, fileObjects, chunks := createRandomChunks([]string{"a"}, 1)
+		testhelper.CreateMockChunkBegin(&database, referralId, path.Join("", fmt.Sprint(referralId)), fileObjects, handler, chunks)
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 4)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- uploadChunk(referralId, "a", 0, data["a"][0], originHospitalId).Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+		accepted := 0
+		for code := range codes {
+			if code == 200 {
+				accepted++
+			}
+		}
+		if accepted != 1 {
+			t.Errorf("got %d accepted uploads, want 1", accepted)
+		}
+	})
+	t.Run("Duplicate tracking", func(t *testing.T) {
+		referralId, _ := testhelper.CreateMockReferral(handler.Database)
+		_, fileObjects, chunks := createRandomChunks([]string{"a"}, 2)
+		testhelper.CreateMockFiles(handler.Database, referralId, "", fileObjects)
+		files, _ := handler.Database.GetFilesByReferral(referralId)
+		fileMap := db.FilestoMap(files)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- handler.AddFileTracking(fileMap, referralId, []uploadhandler.ChunkFile{
+					{Name: "a", Chunks: append([]uploadhandler.Chunk{}, chunks["a"]...)},
+				})
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		accepted := 0
+		for err := range errs {
+			if err == nil {
+				accepted++
+			}
+		}
+		if accepted != 1 {
+			t.Errorf("got %d accepted trackings, want 1", accepted)
+		}
+	})
+}
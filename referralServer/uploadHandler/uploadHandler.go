@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,17 +12,18 @@ import (
 	"path"
 	"simplemts/lib"
 	db "simplemts/lib/database"
+	statemachine "simplemts/lib/stateMachine"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
 type UploadHandler struct {
-	Database             *db.Database
-	payloadDir           string
-	chunkDir             string
-	chunkTrackingList    map[int](map[string]ChunkFile)
-	downloadTrackingList map[int](map[string]ChunkFile)
+	Database   *db.Database
+	payloadDir string
+	chunkDir   string
+	locks      *referralLocks
 }
 
 type ChunkFile = db.ChunkFile
@@ -33,13 +35,20 @@ const (
 	Complete   = db.CompleteChunk
 )
 
+// Upload state of a referral file, chunks are empty if the file is not tracked
+type FileUploadStatus = struct {
+	Name         string          `json:"Name"`
+	Checksum     string          `json:"Checksum"`
+	UploadStatus db.UploadStatus `json:"UploadStatus"`
+	Chunks       []Chunk         `json:"Chunks"`
+}
+
 func NewUploadHandler(database *db.Database) UploadHandler {
 	return UploadHandler{
-		Database:             database,
-		payloadDir:           lib.GetEnv("SERVER_PAYLOAD_DIR", "../../upload"),
-		chunkDir:             lib.GetEnv("SERVER_CHUNK_DIR", "../../chunk"),
-		chunkTrackingList:    make(map[int](map[string]ChunkFile)),
-		downloadTrackingList: make(map[int](map[string]ChunkFile)),
+		Database:   database,
+		payloadDir: lib.GetEnv("SERVER_PAYLOAD_DIR", "../../upload"),
+		chunkDir:   lib.GetEnv("SERVER_CHUNK_DIR", "../../chunk"),
+		locks:      newReferralLocks(),
 	}
 }
 
@@ -51,8 +60,10 @@ func (rh *UploadHandler) Initiate(w http.ResponseWriter, r *http.Request) {
 	}
 	clientHospitalId := lib.GetContextHospital(r)
 	response := struct {
-		PayloadKey string          `json:"PayloadKey" validate:"required"`
-		Files      []db.FileObject `json:"Files" validate:"required,unique=Name,dive"`
+		PayloadKey        string          `json:"PayloadKey" validate:"required"`
+		Files             []db.FileObject `json:"Files" validate:"required,unique=Name,dive"`
+		Manifest          string          `json:"Manifest" validate:"required"`
+		ManifestSignature string          `json:"ManifestSignature" validate:"required"`
 	}{}
 	// Syntax check
 	err = lib.DecodeValidate(&response, r.Body)
@@ -61,44 +72,178 @@ func (rh *UploadHandler) Initiate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Semantic Check
+	if !strings.HasPrefix(response.PayloadKey, lib.WrappedKeyPrefix) {
+		lib.ErrorMessageHandler(w, r, 400, "Payload key needs to be wrapped for the destination")
+		return
+	}
 	referral, ok := rh.Database.GetReferralById(referralId)
 	if !ok {
 		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
 		return
 	}
-	if referral.Origin != clientHospitalId {
-		lib.ErrorMessageHandler(w, r, 400, "Origin mismatch: client does not have permission to grant referral")
+	actor, ok := statemachine.HospitalActor(referral, clientHospitalId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to upload")
 		return
 	}
-	if referral.ReferralStatus != db.Granted { // TODO send extra data, can upload again
-		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not set to upload incomplete: referral is in state %s", referral.ReferralStatus))
+	if _, err = statemachine.Find(referral.ReferralStatus, statemachine.Flow(referral).Uploading, actor); err != nil {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not set to upload incomplete: %s", err))
 		return
 	}
-	parentPath := path.Join(rh.payloadDir, fmt.Sprint(referralId)) // file exists in /upload/referralId/fileId
+	// Signature is checked by the destination, manifest has to describe this upload
+	manifest, err := lib.ParseManifest(response.Manifest)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not parse manifest: %s", err))
+		return
+	}
+	checksums := make(map[string]string, len(response.Files))
 	for _, file := range response.Files {
-		f := db.File{
-			FileObject: file,
-			Referral:   referralId,
-			ParentPath: parentPath,
-		}
-		_, ok := rh.Database.ServerCreateFile(f)
-		if !ok {
-			// TODO clean up
-			lib.ErrorMessageHandler(w, r, 400, "Could not create file")
-			return
-		}
+		checksums[file.Name] = file.Checksum
 	}
-	rh.Database.UpdatePayloadKeyById(referralId, response.PayloadKey)
-	ok = rh.Database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
-	if !ok {
-		lib.ErrorMessageHandler(w, r, 400, "Could not update referral")
+	if manifest.ReferralId != referralId || manifest.Origin != referral.Origin || !manifest.Matches(checksums) {
+		lib.ErrorMessageHandler(w, r, 400, "Manifest does not match upload")
+		return
+	}
+	// Files are created with the status, a concurrent initiate gets a conflict instead of creating them twice
+	parentPath := path.Join(rh.payloadDir, fmt.Sprint(referralId)) // file exists in /upload/referralId/fileId
+	err = statemachine.Apply(rh.Database, referral, statemachine.Trigger{
+		Actor:   actor,
+		ActorId: clientHospitalId,
+		Details: fmt.Sprintf("%d files", len(response.Files)),
+		Updates: map[string]interface{}{
+			"payload_key":        response.PayloadKey,
+			"manifest":           response.Manifest,
+			"manifest_signature": response.ManifestSignature,
+		},
+		Effects: []statemachine.Effect{func(database *db.Database, referralId int) error {
+			for _, file := range response.Files {
+				f := db.File{
+					FileObject: file,
+					Referral:   referralId,
+					ParentPath: parentPath,
+				}
+				if _, ok := database.ServerCreateFile(f); !ok {
+					return fmt.Errorf("could not create file %s", file.Name)
+				}
+			}
+			return nil
+		}},
+	}, statemachine.Flow(referral).Uploading)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not set to upload incomplete: %s", err))
 		return
 	}
 	fmt.Println("Initiated: ", referralId)
 	w.WriteHeader(201)
 }
 
-func (*UploadHandler) Error(w http.ResponseWriter, r *http.Request) {
+// Aborts an upload: chunks, merged payloads and file rows are removed
+// and the referral goes back to Granted (CounterCreated) so the origin can initiate again
+func (rh *UploadHandler) Error(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	// Semantic Check
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	actor, ok := statemachine.HospitalActor(referral, clientHospitalId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to abort upload")
+		return
+	}
+	unlock := rh.locks.lock(referralId)
+	defer unlock()
+	// Status read again under lock, Complete could have finished
+	referral, _ = rh.Database.GetReferralById(referralId)
+	if _, err = statemachine.Find(referral.ReferralStatus, statemachine.Flow(referral).Ready, actor); err != nil {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not abort upload: %s", err))
+		return
+	}
+	// Work
+	err = os.RemoveAll(path.Join(rh.chunkDir, fmt.Sprintf("referral-%d", referralId)))
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, "Could not remove chunks")
+		return
+	}
+	err = os.RemoveAll(path.Join(rh.payloadDir, fmt.Sprintf("referral-%d", referralId)))
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, "Could not remove payload")
+		return
+	}
+	// tracking, files and key are reset by the transition
+	err = statemachine.Apply(rh.Database, referral, statemachine.Trigger{
+		Actor:   actor,
+		ActorId: clientHospitalId,
+		Details: "Upload aborted",
+	}, statemachine.Flow(referral).Ready)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not abort upload: %s", err))
+		return
+	}
+	fmt.Println("Upload aborted: ", referralId)
+	w.WriteHeader(200)
+}
+
+// Origin withdraws a referral, under the referral lock so no chunk or completion
+// runs alongside; chunks, merged payloads and file rows are purged
+func (rh *UploadHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	response := struct {
+		Reason string `json:"Reason" validate:"required"`
+	}{}
+	// Syntax check
+	err = lib.DecodeValidate(&response, r.Body)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	// Semantic Check
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	actor, ok := statemachine.HospitalActor(referral, clientHospitalId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to cancel")
+		return
+	}
+	unlock := rh.locks.lock(referralId)
+	defer unlock()
+	referral, _ = rh.Database.GetReferralById(referralId)
+	// Work
+	err = statemachine.Apply(rh.Database, referral, statemachine.Trigger{
+		Actor:   actor,
+		ActorId: clientHospitalId,
+		Details: response.Reason,
+		Updates: map[string]interface{}{"cancel_reason": response.Reason},
+	}, db.Cancelled)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not cancel referral: %s", err))
+		return
+	}
+	// The referral is cancelled either way, leftover files are only logged
+	err = os.RemoveAll(path.Join(rh.chunkDir, fmt.Sprintf("referral-%d", referralId)))
+	if err != nil {
+		fmt.Println("Could not remove chunks: ", referralId, err)
+	}
+	err = os.RemoveAll(path.Join(rh.payloadDir, fmt.Sprintf("referral-%d", referralId)))
+	if err != nil {
+		fmt.Println("Could not remove payload: ", referralId, err)
+	}
+	fmt.Println("Cancelled: ", referralId)
+	w.WriteHeader(200)
 }
 
 // Situation: file tracking list exists filename:complete/incomplete,checksum
@@ -108,8 +253,15 @@ func (*UploadHandler) Error(w http.ResponseWriter, r *http.Request) {
 // updateFiles = new files are added, check filename same
 
 func (rh *UploadHandler) AddFileTracking(files map[string]db.File, referralId int, newChunkTracking []ChunkFile) (err error) {
-	if _, exists := rh.chunkTrackingList[referralId]; !exists {
-		rh.chunkTrackingList[referralId] = make(map[string]ChunkFile, 0)
+	unlock := rh.locks.lock(referralId)
+	defer unlock()
+	referralTracking, ok := rh.Database.GetChunkFilesByReferral(referralId)
+	if !ok {
+		return fmt.Errorf("could not get tracking for referral '%d'", referralId)
+	}
+	tracked := make(map[string]bool)
+	for _, cf := range referralTracking {
+		tracked[cf.Name] = true
 	}
 	for _, cf := range newChunkTracking {
 		// Check file exists
@@ -122,42 +274,104 @@ func (rh *UploadHandler) AddFileTracking(files map[string]db.File, referralId in
 			return fmt.Errorf("file '%s' has already been uploaded", cf.Name)
 		}
 		// Check if file is in tracking already
-		if _, exists := rh.chunkTrackingList[referralId][cf.Name]; exists {
+		if tracked[cf.Name] {
 			return fmt.Errorf("file '%s' is uploading", cf.Name)
 		}
 	}
-	rh.chunkTrackingList[referralId] = make(map[string]ChunkFile)
 	for _, cf := range newChunkTracking {
 		// chunk status incomplete
 		for i := range cf.Chunks {
 			cf.Chunks[i].Status = Incomplete
 		}
-		rh.chunkTrackingList[referralId][cf.Name] = cf
+	}
+	if !rh.Database.CreateChunkFiles(referralId, newChunkTracking) {
+		return fmt.Errorf("could not track chunks for referral '%d'", referralId)
 	}
 	return nil
 }
 
 func (rh UploadHandler) getIncompleteTrackingChunk(referralId int,
 	filename string, chunkIndex int) (chunk Chunk, err error) {
-	// referralId exists
-	referralTracking, exists := rh.chunkTrackingList[referralId]
+	// chunk exists, filename and chunkIndex in bounds
+	chunk, exists := rh.Database.GetChunk(referralId, filename, chunkIndex)
 	if !exists {
-		return Chunk{}, fmt.Errorf("referral '%d' is not accepting chunks", referralId)
-	}
-	// filename exists
-	fileTracking, exists := referralTracking[filename]
-	if !exists {
-		return Chunk{}, fmt.Errorf("file '%s' is not accepting chunks", filename)
-	}
-	// chunkIndex is not out of bound
-	if chunkIndex >= len(fileTracking.Chunks) {
-		return Chunk{}, fmt.Errorf("chunk index is out of bounds")
+		return Chunk{}, fmt.Errorf("file '%s' chunk %d is not accepting chunks", filename, chunkIndex)
 	}
 	// chunk alredy complete
-	if fileTracking.Chunks[chunkIndex].Status == Complete {
+	if chunk.Status == Complete {
 		return Chunk{}, fmt.Errorf("chunk is already complete")
 	}
-	return fileTracking.Chunks[chunkIndex], nil
+	return chunk, nil
+}
+
+func (rh *UploadHandler) getUploadStatus(referralId int) (statusList []FileUploadStatus, err error) {
+	files, ok := rh.Database.GetFilesByReferral(referralId)
+	if !ok {
+		return nil, fmt.Errorf("could not find files for referral '%d'", referralId)
+	}
+	referralTracking, ok := rh.Database.GetChunkFilesByReferral(referralId)
+	if !ok {
+		return nil, fmt.Errorf("could not get tracking for referral '%d'", referralId)
+	}
+	trackingMap := make(map[string]ChunkFile)
+	for _, cf := range referralTracking {
+		trackingMap[cf.Name] = cf
+	}
+	statusList = []FileUploadStatus{}
+	for _, file := range files {
+		chunks := trackingMap[file.Name].Chunks
+		if chunks == nil {
+			chunks = []Chunk{}
+		}
+		statusList = append(statusList, FileUploadStatus{
+			Name:         file.Name,
+			Checksum:     file.Checksum,
+			UploadStatus: file.UploadStatus,
+			Chunks:       chunks,
+		})
+	}
+	return statusList, nil
+}
+
+func (rh *UploadHandler) Status(w http.ResponseWriter, r *http.Request) {
+	referralId, err := lib.GetReferralId(r)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
+	clientHospitalId := lib.GetContextHospital(r)
+	// Semantic Check
+	referral, ok := rh.Database.GetReferralById(referralId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
+		return
+	}
+	if referral.Origin != clientHospitalId {
+		lib.ErrorMessageHandler(w, r, 400, "Origin mismatch: client does not have permission to view upload")
+		return
+	}
+	// Work
+	unlock := rh.locks.lock(referralId)
+	statusList, err := rh.getUploadStatus(referralId)
+	unlock()
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 500, err.Error())
+		return
+	}
+	response := struct {
+		ReferralStatus db.ReferralStatus  `json:"ReferralStatus"`
+		Files          []FileUploadStatus `json:"Files"`
+	}{
+		ReferralStatus: referral.ReferralStatus,
+		Files:          statusList,
+	}
+	res, err := json.Marshal(response)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, "Could not encode response")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprint(w, string(res))
 }
 
 // Data Transfer
@@ -187,7 +401,7 @@ func (rh *UploadHandler) ChunkBegin(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, "Origin mismatch: client does not have permission to upload")
 		return
 	}
-	if referral.ReferralStatus != db.UploadIncomplete {
+	if referral.ReferralStatus != statemachine.Flow(referral).Uploading {
 		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not upload: referral is in state %s", referral.ReferralStatus))
 		return
 	}
@@ -236,12 +450,7 @@ func (rh *UploadHandler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 400, "Origin mismatch: client does not have permission to upload")
 		return
 	}
-	chunk, err := rh.getIncompleteTrackingChunk(referralId, filename, chunkIndex)
-	if err != nil {
-		lib.ErrorMessageHandler(w, r, 400, err.Error())
-		return
-	}
-	// Checksum
+	// Checksum, body is read before locking so chunks can be received in parallel
 	var bodyBuffer bytes.Buffer
 	hash := sha256.New()
 	teeReader := io.TeeReader(r.Body, &bodyBuffer)
@@ -251,6 +460,19 @@ func (rh *UploadHandler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	resultChecksum := hex.EncodeToString(hash.Sum(nil))
 
+	unlock := rh.locks.lock(referralId)
+	defer unlock()
+	// Status read again under lock, the upload could have been aborted or cancelled
+	referral, _ = rh.Database.GetReferralById(referralId)
+	if referral.ReferralStatus != statemachine.Flow(referral).Uploading {
+		lib.ErrorMessageHandler(w, r, 409, fmt.Sprintf("Could not upload: referral is in state %s", referral.ReferralStatus))
+		return
+	}
+	chunk, err := rh.getIncompleteTrackingChunk(referralId, filename, chunkIndex)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, 400, err.Error())
+		return
+	}
 	if resultChecksum != chunk.Checksum {
 		lib.ErrorMessageHandler(w, r, 400, "Checksum mismatch")
 		return
@@ -277,7 +499,11 @@ func (rh *UploadHandler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// chunk is saved
-	rh.chunkTrackingList[referralId][filename].Chunks[chunkIndex].Status = Complete
+	ok = rh.Database.UpdateStatusChunk(referralId, filename, chunkIndex, Complete)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 500, "Could not update chunk status")
+		return
+	}
 	w.WriteHeader(200)
 	fmt.Println("Chunk Done: ", referralId, "Index:", chunkIndex)
 }
@@ -289,20 +515,42 @@ func MergeChunks(outPath string, inDir string, inFiles []string) (err error) {
 	}
 	defer out.Close()
 	for _, filename := range inFiles {
-		filePath := path.Join(inDir, filename)
-		file, err := os.Open(filePath)
+		err = appendChunk(out, path.Join(inDir, filename))
 		if err != nil {
-			return fmt.Errorf("could not open chunk file")
+			return err
 		}
-		_, err = io.Copy(out, file)
-		if err != nil {
-			return fmt.Errorf("could not append chunk to output")
-		}
-		file.Close()
+	}
+	if err = out.Close(); err != nil {
+		return fmt.Errorf("could not write output file")
+	}
+	return nil
+}
+
+func appendChunk(out io.Writer, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("could not open chunk file")
+	}
+	defer file.Close()
+	if _, err = io.Copy(out, file); err != nil {
+		return fmt.Errorf("could not append chunk to output")
 	}
 	return nil
 }
 
+func fileChecksum(filePath string) (checksum string, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func (rh *UploadHandler) Complete(w http.ResponseWriter, r *http.Request) {
 	clientHospitalId := lib.GetContextHospital(r)
 	// URL vars
@@ -317,13 +565,22 @@ func (rh *UploadHandler) Complete(w http.ResponseWriter, r *http.Request) {
 		lib.ErrorMessageHandler(w, r, 404, "Could not find referral")
 		return
 	}
-	if referral.Origin != clientHospitalId {
-		lib.ErrorMessageHandler(w, r, 400, "Origin mismatch: client does not have permission to upload")
+	actor, ok := statemachine.HospitalActor(referral, clientHospitalId)
+	if !ok {
+		lib.ErrorMessageHandler(w, r, 400, "Hospital mismatch: client does not have permission to upload")
+		return
+	}
+	unlock := rh.locks.lock(referralId)
+	defer unlock()
+	// Status read again under lock, another Complete could have finished
+	referral, _ = rh.Database.GetReferralById(referralId)
+	if _, err = statemachine.Find(referral.ReferralStatus, statemachine.Flow(referral).Uploaded, actor); err != nil {
+		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Could not complete upload: %s", err))
 		return
 	}
 	// Work: Sync tracking with db files
-	referralTracking, exists := rh.chunkTrackingList[referralId]
-	if !exists {
+	referralTracking, ok := rh.Database.GetChunkFilesByReferral(referralId)
+	if !ok || len(referralTracking) == 0 {
 		lib.ErrorMessageHandler(w, r, 400, fmt.Sprintf("Not tracking referral '%d'", referralId))
 		return
 	}
@@ -344,8 +601,11 @@ func (rh *UploadHandler) Complete(w http.ResponseWriter, r *http.Request) {
 				break // incomplete chunk, skip this file
 			}
 		}
+		if fileComplete && fileMap[chunkfile.Name].UploadStatus == db.CompleteUpload {
+			continue // merged by an earlier call
+		}
 		if fileComplete {
-			// merge chunks
+			// merge chunks, renamed into place once the checksum matches
 			outPath := path.Join(
 				rh.payloadDir,
 				fmt.Sprintf("referral-%d", referralId),
@@ -360,29 +620,28 @@ func (rh *UploadHandler) Complete(w http.ResponseWriter, r *http.Request) {
 			for i := range chunkfile.Chunks {
 				inFiles = append(inFiles, fmt.Sprintf("chunk-%d", i))
 			}
-			err := MergeChunks(outPath, inDir, inFiles)
+			partPath := outPath + ".part"
+			err := MergeChunks(partPath, inDir, inFiles)
 			if err != nil {
 				lib.ErrorMessageHandler(w, r, 500, err.Error())
 				return
 			}
 			// checksum
-			hash := sha256.New()
-			out, err := os.Open(outPath)
+			resultChecksum, err := fileChecksum(partPath)
 			if err != nil {
 				lib.ErrorMessageHandler(w, r, 500, err.Error())
 				return
 			}
-			if _, err := io.Copy(hash, out); err != nil {
-				lib.ErrorMessageHandler(w, r, 400, err.Error())
-				return
-			}
-			resultChecksum := hex.EncodeToString(hash.Sum(nil))
 			targetFile := fileMap[chunkfile.Name]
 			if resultChecksum != targetFile.Checksum {
 				// Checksum error
 				lib.ErrorMessageHandler(w, r, 400, "File checksum error")
 				return
 			}
+			if err := os.Rename(partPath, outPath); err != nil {
+				lib.ErrorMessageHandler(w, r, 500, "Could not save merged file")
+				return
+			}
 			// update file state
 			ok := rh.Database.UpdateStatusFileById(targetFile.Id, db.CompleteUpload)
 			if !ok {
@@ -404,13 +663,33 @@ func (rh *UploadHandler) Complete(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if !allComplete {
-		// TODO send tracking list as well
-		lib.ErrorMessageHandler(w, r, 202, "Incomplete files")
+		statusList, err := rh.getUploadStatus(referralId)
+		if err != nil {
+			lib.ErrorMessageHandler(w, r, 500, err.Error())
+			return
+		}
+		response := struct {
+			Message string             `json:"message"`
+			Files   []FileUploadStatus `json:"Files"`
+		}{
+			Message: "Incomplete files",
+			Files:   statusList,
+		}
+		res, err := json.Marshal(response)
+		if err != nil {
+			lib.ErrorMessageHandler(w, r, 500, "Could not encode response")
+			return
+		}
+		w.WriteHeader(202)
+		fmt.Fprint(w, string(res))
 		return
 	}
-	ok = rh.Database.UpdateStatusReferralById(referralId, db.UploadComplete)
-	if !ok {
-		lib.ErrorMessageHandler(w, r, 202, "Could not set referral")
+	err = statemachine.Apply(rh.Database, referral, statemachine.Trigger{
+		Actor:   actor,
+		ActorId: clientHospitalId,
+	}, statemachine.Flow(referral).Uploaded)
+	if err != nil {
+		lib.ErrorMessageHandler(w, r, statemachine.HTTPStatus(err), fmt.Sprintf("Could not set referral: %s", err))
 		return
 	}
 	w.WriteHeader(200)
@@ -2,11 +2,13 @@ package uploadhandler_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
+	"regexp"
 	"simplemts/lib"
 	db "simplemts/lib/database"
 	testhelper "simplemts/lib/testHelper"
@@ -28,12 +30,62 @@ func TestInitiate(t *testing.T) {
 	t.Logf("Created Referral %d\n", referralId)
 	handler.Database.UpdateStatusReferralById(referralId, db.Granted)
 
+	files := `[
+		{"Name":"a","Checksum":"OK"},
+		{"Name":"b","Checksum":"OK"},
+		{"Name":"c","Checksum":"OK"}
+	]`
+	initiate := func(manifestReferralId int, manifestFiles string) *httptest.ResponseRecorder {
+		manifest, _ := json.Marshal(fmt.Sprintf(`{"ReferralId":%d,"Origin":"%s","Files":%s}`,
+			manifestReferralId, originHospitalId, manifestFiles))
+		bodyReader := bytes.NewReader([]byte(fmt.Sprintf(`{
+			"PayloadKey": "%sa2V5",
+			"Files": %s,
+			"Manifest": %s,
+			"ManifestSignature": "c2lnbmF0dXJl"
+		}`, lib.WrappedKeyPrefix, files, manifest)))
+		request, _ := http.NewRequest(http.MethodGet, "/{referralId}/upload", bodyReader)
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		vars := map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		}
+		requestWithVars := mux.SetURLVars(requestWithContext, vars)
+		response := httptest.NewRecorder()
+		handler.Initiate(response, requestWithVars)
+		return response
+	}
+
+	t.Run("Manifest mismatch", func(t *testing.T) {
+		for name, response := range map[string]*httptest.ResponseRecorder{
+			"referral": initiate(referralId+1, files),
+			"files":    initiate(referralId, `[{"Name":"a","Checksum":"OK"}]`),
+			"checksum": initiate(referralId, `[{"Name":"a","Checksum":"OK"},{"Name":"b","Checksum":"OK"},{"Name":"c","Checksum":"BAD"}]`),
+		} {
+			if response.Code != 400 {
+				t.Errorf("%s: got %d, want 400: response: %s", name, response.Code, response.Body.String())
+			}
+		}
+	})
 	t.Run("Normal", func(t *testing.T) {
+		response := initiate(referralId, files)
+		gotstatus := response.Result().StatusCode
+		got := response.Body.String()
+		wantstatus := 201
+
+		if gotstatus != wantstatus {
+			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
+			return
+		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		if referral.Manifest == "" || referral.ManifestSignature != "c2lnbmF0dXJl" {
+			t.Errorf("Manifest was not stored")
+		}
+	})
+	t.Run("Unwrapped key", func(t *testing.T) {
 		bodyReader := bytes.NewReader([]byte(`{
+			"PayloadKey": "00112233445566778899aabbccddeeff",
 			"Files": [
-				{"Name":"a","Checksum":"OK"},
-				{"Name":"b","Checksum":"OK"},
-				{"Name":"c","Checksum":"OK"}
+				{"Name":"a","Checksum":"OK"}
 			]
 		}`))
 		request, _ := http.NewRequest(http.MethodGet, "/{referralId}/upload", bodyReader)
@@ -46,11 +98,10 @@ func TestInitiate(t *testing.T) {
 		handler.Initiate(response, requestWithVars)
 		gotstatus := response.Result().StatusCode
 		got := response.Body.String()
-		wantstatus := 201
+		wantstatus := 400
 
 		if gotstatus != wantstatus {
 			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
-			return
 		}
 	})
 }
@@ -188,6 +239,27 @@ func TestChunkUpload(t *testing.T) {
 		got := response.Body.String()
 		wantstatus := 200
 
+		if gotstatus != wantstatus {
+			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
+			return
+		}
+	})
+	t.Run("Upload aborted", func(t *testing.T) {
+		handler.Database.UpdateStatusReferralById(referralId, db.Granted)
+		request, _ := http.NewRequest(http.MethodGet, "/{referralId}/upload", bytes.NewReader([]byte("a")))
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		vars := map[string]string{
+			"referralId": fmt.Sprint(referralId),
+			"filename":   "c",
+			"chunkIndex": "0",
+		}
+		requestWithVars := mux.SetURLVars(requestWithContext, vars)
+		response := httptest.NewRecorder()
+		handler.ChunkUpload(response, requestWithVars)
+		gotstatus := response.Result().StatusCode
+		got := response.Body.String()
+		wantstatus := 409
+
 		if gotstatus != wantstatus {
 			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
 			return
@@ -266,3 +338,185 @@ func TestComplete(t *testing.T) {
 		}
 	})
 }
+
+func TestStatus(t *testing.T) {
+	clientHospitalId := originHospitalId
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	t.Logf("Created Referral %d\n", referralId)
+	handler.Database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+	parentPath := path.Join("", fmt.Sprint(referralId))
+	data, fileObjects, chunks := createRandomChunks([]string{"a"}, 2)
+	testhelper.CreateMockChunkBegin(&database, referralId, parentPath, fileObjects, handler, chunks)
+	uploadChunk(referralId, "a", 1, data["a"][1], clientHospitalId)
+
+	t.Run("Normal", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/{referralId}/upload/status", nil)
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		vars := map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		}
+		requestWithVars := mux.SetURLVars(requestWithContext, vars)
+		response := httptest.NewRecorder()
+		handler.Status(response, requestWithVars)
+		gotstatus := response.Result().StatusCode
+		got := response.Body.String()
+		wantstatus := 200
+
+		if gotstatus != wantstatus {
+			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
+			return
+		}
+		match, _ := regexp.MatchString(`^{"ReferralStatus":"UploadIncomplete","Files":\[{"Name":"a","Checksum":"[0-9a-f]+","UploadStatus":"","Chunks":\[{"Checksum":"[0-9a-f]+","SizeKB":1,"Status":"Incomplete"},{"Checksum":"[0-9a-f]+","SizeKB":1,"Status":"Complete"}\]}\]}$`, got)
+		if !match {
+			t.Errorf(`Unexpected response: "%s"`, got)
+			return
+		}
+	})
+	t.Run("Not origin", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/{referralId}/upload/status", nil)
+		requestWithContext := lib.AddHospitalContext(request, destinationHospitalId)
+		vars := map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		}
+		requestWithVars := mux.SetURLVars(requestWithContext, vars)
+		response := httptest.NewRecorder()
+		handler.Status(response, requestWithVars)
+		gotstatus := response.Result().StatusCode
+		got := response.Body.String()
+		wantstatus := 400
+
+		if gotstatus != wantstatus {
+			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
+			return
+		}
+	})
+}
+
+func TestError(t *testing.T) {
+	clientHospitalId := originHospitalId
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	t.Logf("Created Referral %d\n", referralId)
+	handler.Database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+	parentPath := path.Join("", fmt.Sprint(referralId))
+	data, fileObjects, chunks := createRandomChunks([]string{"a"}, 2)
+	testhelper.CreateMockChunkBegin(&database, referralId, parentPath, fileObjects, handler, chunks)
+	uploadChunk(referralId, "a", 0, data["a"][0], clientHospitalId)
+
+	abort := func() *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, "/{referralId}/upload/error", nil)
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		vars := map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		}
+		requestWithVars := mux.SetURLVars(requestWithContext, vars)
+		response := httptest.NewRecorder()
+		handler.Error(response, requestWithVars)
+		return response
+	}
+	t.Run("Normal", func(t *testing.T) {
+		response := abort()
+		gotstatus := response.Result().StatusCode
+		got := response.Body.String()
+		wantstatus := 200
+
+		if gotstatus != wantstatus {
+			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
+			return
+		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		if referral.ReferralStatus != db.Granted {
+			t.Errorf("got %s, want %s", referral.ReferralStatus, db.Granted)
+		}
+		files, _ := handler.Database.GetFilesByReferral(referralId)
+		if len(files) != 0 {
+			t.Errorf("got %d files, want 0", len(files))
+		}
+		tracking, _ := handler.Database.GetChunkFilesByReferral(referralId)
+		if len(tracking) != 0 {
+			t.Errorf("got %d tracked files, want 0", len(tracking))
+		}
+	})
+	t.Run("Not uploading", func(t *testing.T) {
+		response := abort()
+		gotstatus := response.Result().StatusCode
+		got := response.Body.String()
+		wantstatus := 400
+
+		if gotstatus != wantstatus {
+			t.Errorf("got %d, want %d: response: %s\b", gotstatus, wantstatus, got)
+			return
+		}
+	})
+}
+
+func TestCancel(t *testing.T) {
+	referralId, _ := testhelper.CreateMockReferral(handler.Database)
+	handler.Database.UpdateStatusReferralById(referralId, db.UploadIncomplete)
+	parentPath := path.Join("", fmt.Sprint(referralId))
+	data, fileObjects, chunks := createRandomChunks([]string{"a"}, 2)
+	testhelper.CreateMockChunkBegin(&database, referralId, parentPath, fileObjects, handler, chunks)
+	uploadChunk(referralId, "a", 0, data["a"][0], originHospitalId)
+
+	cancel := func(referralId int, clientHospitalId string, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, "/{referralId}/cancel", bytes.NewReader([]byte(body)))
+		requestWithContext := lib.AddHospitalContext(request, clientHospitalId)
+		requestWithVars := mux.SetURLVars(requestWithContext, map[string]string{
+			"referralId": fmt.Sprint(referralId),
+		})
+		response := httptest.NewRecorder()
+		handler.Cancel(response, requestWithVars)
+		return response
+	}
+	t.Run("No reason", func(t *testing.T) {
+		response := cancel(referralId, originHospitalId, `{}`)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Destination", func(t *testing.T) {
+		response := cancel(referralId, destinationHospitalId, `{"Reason": "test"}`)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+	t.Run("Normal", func(t *testing.T) {
+		response := cancel(referralId, originHospitalId, `{"Reason": "Created by mistake"}`)
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+			return
+		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		if referral.ReferralStatus != db.Cancelled || referral.CancelReason != "Created by mistake" {
+			t.Errorf("got %s %q, want %s", referral.ReferralStatus, referral.CancelReason, db.Cancelled)
+		}
+		files, _ := handler.Database.GetFilesByReferral(referralId)
+		tracking, _ := handler.Database.GetChunkFilesByReferral(referralId)
+		if len(files) != 0 || len(tracking) != 0 {
+			t.Errorf("got %d files and %d tracked files, want 0", len(files), len(tracking))
+		}
+	})
+	t.Run("Forwarded", func(t *testing.T) {
+		// forwarded from Complete, the payload waits for the new destination
+		referralId, _ := testhelper.CreateMockReferral(handler.Database)
+		handler.Database.UpdateStatusReferralById(referralId, db.Forwarded)
+		handler.Database.ServerCreateFile(db.File{FileObject: fileObjects[0], Referral: referralId, ParentPath: parentPath})
+		handler.Database.UpdatePayloadKeyById(referralId, "key")
+		handler.Database.UpdateManifestById(referralId, "manifest", "signature")
+		response := cancel(referralId, originHospitalId, `{"Reason": "Patient moved"}`)
+		if response.Code != 200 {
+			t.Errorf("got %d, want 200: response: %s", response.Code, response.Body.String())
+			return
+		}
+		referral, _ := handler.Database.GetReferralById(referralId)
+		files, _ := handler.Database.GetFilesByReferral(referralId)
+		if len(files) != 0 || referral.PayloadKey != "" || referral.Manifest != "" {
+			t.Errorf("got %d files, key %q and manifest %q, want none", len(files), referral.PayloadKey, referral.Manifest)
+		}
+	})
+	t.Run("Already cancelled", func(t *testing.T) {
+		response := cancel(referralId, originHospitalId, `{"Reason": "again"}`)
+		if response.Code != 400 {
+			t.Errorf("got %d, want 400: response: %s", response.Code, response.Body.String())
+		}
+	})
+}